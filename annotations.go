@@ -0,0 +1,104 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"net/url"
+	"path/filepath"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v3"
+)
+
+// Not in the version of image-spec we build against.
+const annotationBaseDigest = "org.opencontainers.image.base.digest"
+
+// The annotations stacker sets on every image it builds.  A base image's
+// values for these are never inherited, even when stacker has nothing
+// to replace them with.
+var autoAnnotations = []string{
+	ispec.AnnotationCreated,
+	ispec.AnnotationRevision,
+	ispec.AnnotationSource,
+	ispec.AnnotationRefName,
+	annotationBaseDigest,
+}
+
+func (bt *buildTarget) setAnnotations(file string, key *yaml.Node, n *yaml.Node) error {
+	if bt.annotations != nil {
+		return duplicateKeyword(file, key)
+	}
+	bt.annotations = map[string]string{}
+	return forEachPair(file, n, "annotation", func(k, v string, pos recipePos) error {
+		bt.annotations[k] = v
+		return nil
+	})
+}
+
+// Return where the recipe in recipeDir came from: the URL of its git
+// repository's origin if it has one, or else the directory itself.  Any
+// credentials in the URL are left out, as images get published.
+func recipeSource(recipeDir string) string {
+	origin, err := runCaptured("git", "-C", recipeDir, "config", "--get", "remote.origin.url")
+	if err == nil && origin != "" {
+		if u, err := url.Parse(origin); err == nil && u.User != nil {
+			u.User = nil
+			origin = u.String()
+		}
+		return origin
+	}
+	if abs, err := filepath.Abs(recipeDir); err == nil {
+		recipeDir = abs
+	}
+	return "file://" + recipeDir
+}
+
+// Return the annotations for the image t builds from the recipe in
+// recipeDir.  base is the image t is built on, or nil for an empty base.
+// The recipe's own annotations override the ones stacker works out.
+func imageAnnotations(t *buildTarget, recipeDir string, base *ispec.Descriptor) map[string]string {
+	a := map[string]string{
+		ispec.AnnotationCreated: time.Now().UTC().Format(time.RFC3339),
+		ispec.AnnotationSource:  recipeSource(recipeDir),
+		ispec.AnnotationRefName: t.target,
+	}
+	if rev, err := runCaptured("git", "-C", recipeDir, "rev-parse", "HEAD"); err == nil {
+		a[ispec.AnnotationRevision] = rev
+	}
+	if base != nil {
+		a[annotationBaseDigest] = base.Digest.String()
+	}
+	for k, v := range t.annotations {
+		a[k] = v
+	}
+	return a
+}
+
+// Merge annotations into the annotations inherited from a base image,
+// dropping the inherited values of autoAnnotations.
+func mergeAnnotations(inherited map[string]string, annotations map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range inherited {
+		merged[k] = v
+	}
+	for _, k := range autoAnnotations {
+		delete(merged, k)
+	}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	return merged
+}
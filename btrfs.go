@@ -16,37 +16,221 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-        "syscall"
+	"strings"
+	"syscall"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
 )
 
-func btrfsClone(c *stackerConfig, tag string) bool {
-	sha, err := c.GetTagDigest(tag)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed opening tag: %v\n", err)
-		return false
+// The btrfs driver keeps each tag unpacked as a bundle in a subvolume
+// named after the tag, and checks out a tag by snapshotting that
+// subvolume.  Unpack additionally keeps every layer in a subvolume
+// named by its digest, snapshotted from its parent layer's.
+type btrfsStorage struct {
+	c *stackerConfig
+}
+
+func init() {
+	registerStorage("btrfs", func(c *stackerConfig) Storage { return &btrfsStorage{c} })
+}
+
+func (s *btrfsStorage) mount() string {
+	if s.c.BtrfsMount != "" {
+		return s.c.BtrfsMount
 	}
+	return s.c.BaseDir + "/btrfs"
+}
 
-	lower := fmt.Sprintf("%s/%s", c.BtrfsMount, tag)
-	cmd := exec.Command("btrfs", "subvolume", "snapshot", lower, c.UnpackDir())
-	if err = cmd.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "btrfs subvolume snapshot failed: %v\n", err)
-		return false
+func (s *btrfsStorage) Setup() error {
+	return btrfs_loSetup(s.c.LoFile, s.mount())
+}
+
+func (s *btrfsStorage) Teardown() error {
+	return btrfs_loUnsetup(s.c.LoFile, s.mount())
+}
+
+func (s *btrfsStorage) Checkout(tag string) error {
+	lower := filepath.Join(s.mount(), tag)
+	if dirExists(lower) {
+		// The subvolume may have been unpacked from whatever the tag
+		// pointed at before it was moved.
+		meta, err := readBundleMeta(lower)
+		if err != nil {
+			return fmt.Errorf("%s is not a stacker bundle: %v", lower, err)
+		}
+		desc, err := s.c.GetTagDigest(tag)
+		if err != nil {
+			return err
+		}
+		if desc.Digest != meta.From.Digest {
+			if err := DeleteSubvol(s.mount(), tag); err != nil {
+				return fmt.Errorf("Failed deleting stale subvolume for %s: %v", tag, err)
+			}
+		}
+	}
+	if !dirExists(lower) {
+		// The tag has not been unpacked yet; unpack it as a bundle
+		// into its own subvolume so checkouts can snapshot it.
+		if err := CreateSubvol(s.mount(), tag); err != nil {
+			return fmt.Errorf("btrfs subvolume create failed: %v", err)
+		}
+		if err := unpackBundle(s.c.OciDir, tag, lower); err != nil {
+			DeleteSubvol(s.mount(), tag)
+			return fmt.Errorf("Failed unpacking: %v", err)
+		}
 	}
-	d := []byte(tag)
-	fileName := fmt.Sprintf("%s/btrfs.mounted_tag", c.BaseDir)
-	if err = ioutil.WriteFile(fileName, d, 0644); err != nil {
-		fmt.Fprintf(os.Stderr, "Error saving the checked out tag: %s\n", err)
+	cmd := exec.Command("btrfs", "subvolume", "snapshot", lower, s.c.UnpackDir())
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("btrfs subvolume snapshot failed: %v", err)
 	}
-	d = []byte(sha)
-	fileName = fmt.Sprintf("%s/btrfs.mounted_sha", c.BaseDir)
-	if err = ioutil.WriteFile(fileName, d, 0644); err != nil {
-		fmt.Fprintf(os.Stderr, "Error saving the checked out hash: %s\n", err)
+	return nil
+}
+
+// Delete the checkout subvolume.  Only a subvolume directly under the
+// btrfs mount which holds a stacker bundle is deleted; anything else is
+// refused.
+func (s *btrfsStorage) Abort() error {
+	dir := filepath.Clean(s.c.UnpackDir())
+	if filepath.Dir(dir) != filepath.Clean(s.mount()) {
+		return fmt.Errorf("Refusing to delete %s: not under %s", dir, s.mount())
 	}
-	return true
+	if !isSubvolume(dir) {
+		return fmt.Errorf("Refusing to delete %s: not a btrfs subvolume", dir)
+	}
+	if _, err := readBundleMeta(dir); err != nil {
+		return fmt.Errorf("Refusing to delete %s: not a stacker checkout", dir)
+	}
+
+	cmd := exec.Command("btrfs", "subvolume", "delete", dir)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("btrfs subvolume delete failed: %v", err)
+	}
+	return nil
+}
+
+// Check in the checked-out subvolume as tag, then delete it.  Any stale
+// subvolume for tag is removed, so the next checkout of tag unpacks the
+// new image.
+func (s *btrfsStorage) Checkin(tag string, from ispec.Descriptor, update *imageUpdate) error {
+	if err := RepackBundle(s.c.OciDir, tag, s.c.UnpackDir(), from, update); err != nil {
+		return err
+	}
+	if dirExists(filepath.Join(s.mount(), tag)) {
+		if err := DeleteSubvol(s.mount(), tag); err != nil {
+			return fmt.Errorf("Failed removing stale subvolume for %s: %v", tag, err)
+		}
+	}
+	if err := s.Abort(); err != nil {
+		return fmt.Errorf("Failed removing checkout: %v", err)
+	}
+	return nil
+}
+
+func (s *btrfsStorage) RootfsPath() string {
+	return s.mount() + "/mounted" + s.c.checkoutSuffix() + "/rootfs"
+}
+
+func (s *btrfsStorage) Describe(w io.Writer) {
+	h := s.Health()
+	if s.c.LoFile != "" {
+		fmt.Fprintf(w, "  loopback file: %s (exists: %v)\n", s.c.LoFile, h.LoFileExists)
+	}
+	fmt.Fprintf(w, "  mountpoint: %s (mounted: %v)\n", s.mount(), h.Mounted)
+}
+
+func (s *btrfsStorage) Health() storageHealth {
+	h := storageHealth{
+		LoFile:       s.c.LoFile,
+		LoFileExists: s.c.LoFile != "" && FileExists(s.c.LoFile),
+		Mounted:      IsMountpoint(s.mount()),
+	}
+	if h.Mounted {
+		h.Used, h.Size = statfsUsage(s.mount())
+	}
+	return h
+}
+
+func (s *btrfsStorage) Dirty() (bool, error) {
+	diffs, err := bundleDiffs(s.c.UnpackDir())
+	return len(diffs) > 0, err
+}
+
+// Unpack every layer of every tag into a subvolume named after the
+// layer's digest.  Each layer's subvolume is a snapshot of its parent
+// layer's, with the layer applied on top, so layers shared between tags
+// are only unpacked once.
+func (s *btrfsStorage) Unpack() error {
+	mnt := s.mount()
+	return forEachTagManifest(s.c, func(ctx context.Context, engine casext.Engine, manifest ispec.Manifest) error {
+		prevlayer := ""
+		for _, l := range manifest.Layers {
+			name := l.Digest.Encoded()
+			if dirExists(filepath.Join(mnt, name)) {
+				prevlayer = name
+				continue
+			}
+			if prevlayer == "" {
+				if err := CreateSubvol(mnt, name); err != nil {
+					return err
+				}
+			} else {
+				if err := SnapshotSubvol(mnt, prevlayer, name); err != nil {
+					return err
+				}
+			}
+
+			if err := applyLayer(ctx, engine, l, filepath.Join(mnt, name)); err != nil {
+				DeleteSubvol(mnt, name)
+				return fmt.Errorf("Failed unpacking layer %s: %v", l.Digest, err)
+			}
+			prevlayer = name
+		}
+		return nil
+	})
+}
+
+// Delete layer subvolumes no tag uses, and tag subvolumes whose tag is
+// gone or now points at a different image.
+func (s *btrfsStorage) GC() error {
+	layers, err := referencedLayers(s.c)
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(s.mount())
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || name == "mounted" || strings.HasPrefix(name, "mounted-") || layers[name] {
+			continue
+		}
+		if isLayerDigest(name) {
+			if err := DeleteSubvol(s.mount(), name); err != nil {
+				return fmt.Errorf("Failed deleting layer subvolume %s: %v", name, err)
+			}
+			continue
+		}
+		meta, err := readBundleMeta(filepath.Join(s.mount(), name))
+		if err != nil {
+			// Not something we created.
+			continue
+		}
+		desc, err := s.c.GetTagDigest(name)
+		if err != nil || desc.Digest != meta.From.Digest {
+			if err := DeleteSubvol(s.mount(), name); err != nil {
+				return fmt.Errorf("Failed deleting subvolume for %s: %v", name, err)
+			}
+		}
+	}
+	return nil
 }
 
 func IsMountpoint(mnt string) bool {
@@ -72,7 +256,7 @@ func btrfs_loSetup(lofile, mnt string) error {
 		if err := os.MkdirAll(mnt, 0755); err != nil {
 			return err
 		}
-		cmd := exec.Command("mount", "-o", "loop", "-t", "btrfs", lofile, mnt)
+		cmd := exec.Command("mount", "-o", "loop,user_subvol_rm_allowed", "-t", "btrfs", lofile, mnt)
 		if err := cmd.Run(); err != nil {
 			return err
 		}
@@ -94,66 +278,22 @@ func btrfs_loUnsetup(lofile, mnt string) error {
 	return nil
 }
 
-// desired umoci API:
-// image, err := umoci.OpenLayout(ocidir)
-// defer image.Close()
-// for _, tag := image.ListTags() {
-//	prevlayer = ""
-//	for _, l := image.ListTagLayers(tag) {
-// 		if prevlayer == "" {
-//			create_btrfs_subvolume(mnt, image.GetTagLayerDigest(l))
-//		} else {
-//			prevsha = image.GetTagLayerDigest(prevlayer)
-//			newsha = image.GetTagLayerDigest(l)
-//			clone_btrfs_subvolume(mnt, prevsha, newsha)
-//			image.Unpack(newsha, fmt.Sprintf("%s/%s", mnt, newsha)
-//		}
-// }
-func btrfs_Unpack(c *stackerConfig) error {
-	tags, err := c.ListTags()
-	if err != nil {
-		return err
-	}
-	tmpDir, err := ioutil.TempDir("", "stacker_")
-	if err != nil {
-		return err
-	}
-	tmpRootfs := fmt.Sprintf("%s/rootfs", tmpDir)
-	for _, tag := range(tags) {
-		os.RemoveAll(tmpDir)
-		os.MkdirAll(tmpDir, 0755)
-		layers, err := c.TagFsLayers(tag)
-		if err != nil {
-			return err
-		}
-		prevlayer := ""
-		for _, l := range layers {
-			if prevlayer == "" {
-				if err := CreateSubvol(c.BtrfsMount, l); err != nil {
-					return err
-				}
-			} else {
-				if err := SnapshotSubvol(c.BtrfsMount, prevlayer, l); err != nil {
-					return err
-				}
-			}
-
-			image := fmt.Sprintf("%s:%s", c.OciDir, l)
-			// this will fail rihgt now as umoci does not support it
-			cmd := exec.Command("umoci", "unpack", "--image", image, tmpDir)
-			if err := cmd.Run(); err != nil {
-				return err
-			}
+// btrfs gives the root directory of every subvolume inode number 256.
+const (
+	btrfsSuperMagic   = 0x9123683E
+	btrfsFirstFreeIno = 256
+)
 
-			destDir := filepath.Join(c.BtrfsMount, l)
-			cmd = exec.Command("rsync", "-Hax", "--numeric-ids", "--sparse",
-					    "--delete", "--devices", tmpRootfs, destDir)
-			if err := cmd.Run(); err != nil {
-				return err
-			}
-		}
+func isSubvolume(path string) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil || fs.Type != btrfsSuperMagic {
+		return false
 	}
-	return nil
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return false
+	}
+	return st.Mode&syscall.S_IFMT == syscall.S_IFDIR && st.Ino == btrfsFirstFreeIno
 }
 
 func CreateSubvol(mnt, dir string) error {
@@ -168,3 +308,9 @@ func SnapshotSubvol(mnt, old, dir string) error {
 	cmd := exec.Command("btrfs", "subvolume", "snapshot", src, dest)
 	return cmd.Run()
 }
+
+func DeleteSubvol(mnt, dir string) error {
+	dest := filepath.Join(mnt, dir)
+	cmd := exec.Command("btrfs", "subvolume", "delete", dest)
+	return cmd.Run()
+}
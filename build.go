@@ -15,19 +15,57 @@ package main
 // limitations under the License.
 
 import (
+	"bytes"
 	"fmt"
-        "os"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
+// A position in a recipe file, used to report errors.
+type recipePos struct {
+	file string
+	line int
+	col  int
+}
+
+func nodePos(file string, n *yaml.Node) recipePos {
+	return recipePos{file: file, line: n.Line, col: n.Column}
+}
+
+func (p recipePos) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.file, p.line, p.col)
+}
+
+func (p recipePos) Errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s", p, fmt.Sprintf(format, args...))
+}
+
+// A single run, install or expand step.  For an expand step, arg is
+// the archive and digest the optional digest it must have.  For an
+// install step, arg is a glob of the files to install, and install says
+// where and how.
+type buildStep struct {
+	kind    string
+	arg     string
+	digest  string
+	install installOptions
+	pos     recipePos
+}
+
 type buildTarget struct {
-	target     string
-	base       string
-	run        []string
-	expand     []string
-	install    []string
-	entrypoint string
+	target string
+	base   string
+	steps  []buildStep
+	imageSettings
+	// Set on the image's manifest and its tag's index entry.
+	annotations map[string]string
+	pos         recipePos
 }
 
 type buildRecipe struct {
@@ -43,103 +81,266 @@ func (bt *buildRecipe) HasTarget(q string) bool {
 	return false
 }
 
-func (r *buildRecipe) SanityCheck(c *stackerConfig) bool {
-	for k, v := range r.Targets {
+func (r *buildRecipe) Target(q string) *buildTarget {
+	for i := range r.Targets {
+		if r.Targets[i].target == q {
+			return &r.Targets[i]
+		}
+	}
+	return nil
+}
+
+// Return the recipe's targets ordered so that each target comes after
+// the target it uses as base.  Bases which are not targets in this
+// recipe (existing tags, or "empty") impose no ordering.  If the targets
+// depend on each other in a cycle, return an error naming every target
+// in the cycle.
+func (r *buildRecipe) BuildOrder() ([]buildTarget, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	order := []buildTarget{}
+	path := []string{}
+
+	var visit func(t *buildTarget) error
+	visit = func(t *buildTarget) error {
+		switch state[t.target] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for i, p := range path {
+				if p == t.target {
+					start = i
+					break
+				}
+			}
+			cycle := append(append([]string{}, path[start:]...), t.target)
+			return t.pos.Errorf("Dependency cycle: %s", strings.Join(cycle, " -> "))
+		}
+
+		state[t.target] = visiting
+		path = append(path, t.target)
+		if base := r.Target(t.base); base != nil {
+			if err := visit(base); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[t.target] = visited
+		order = append(order, *t)
+		return nil
+	}
+
+	for i := range r.Targets {
+		if err := visit(&r.Targets[i]); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Return a recipe holding just the named targets and the targets they
+// are (transitively) based on.  If depsOnly is set, the named targets
+// themselves are left out, unless another named target needs them.
+func (r *buildRecipe) Subset(names []string, depsOnly bool) (*buildRecipe, error) {
+	want := map[string]bool{}
+	var add func(name string)
+	add = func(name string) {
+		t := r.Target(name)
+		if t == nil || want[name] {
+			return
+		}
+		want[name] = true
+		add(t.base)
+	}
+	for _, name := range names {
+		t := r.Target(name)
+		if t == nil {
+			return nil, fmt.Errorf("No target %s in recipe", name)
+		}
+		if depsOnly {
+			add(t.base)
+		} else {
+			add(name)
+		}
+	}
+
+	sub := &buildRecipe{}
+	for _, t := range r.Targets {
+		if want[t.target] {
+			sub.Targets = append(sub.Targets, t)
+		}
+	}
+	return sub, nil
+}
+
+func (r *buildRecipe) SanityCheck(c *stackerConfig) error {
+	for _, v := range r.Targets {
 		if v.base == "" {
-			fmt.Fprintf(os.Stderr, "No base defined for target %s\n", k)
-			return false
+			return v.pos.Errorf("No base defined for target %s", v.target)
 		}
 		if !c.OCITagExists(v.base) && !r.HasTarget(v.base) && v.base != "empty" {
-			fmt.Fprintf(os.Stderr, "Nonexistent base: %s\n", v.base)
-			return false
+			return v.pos.Errorf("Nonexistent base for target %s: %s", v.target, v.base)
 		}
-		if len(v.run) == 0 && len(v.expand) == 0 && len(v.expand) == 0 && len(v.install) == 0 && v.entrypoint == "" {
-			fmt.Fprintf(os.Stderr, "No work for target: %s\n", k)
-			return false
+		if len(v.steps) == 0 && !v.hasConfig() && v.annotations == nil {
+			return v.pos.Errorf("No work for target: %s", v.target)
 		}
 	}
 
-	return true
+	return nil
 }
 
-func (bt *buildTarget) setBase(i interface{}) error {
-	switch i.(type) {
-	case string:
-	default:
-		return fmt.Errorf("Parse error reading base at %s", bt.target)
+// Return the value of a scalar node, or an error if n is not a scalar.
+func scalarValue(file string, n *yaml.Node, what string) (string, error) {
+	if n.Kind != yaml.ScalarNode || n.Tag == "!!null" {
+		return "", nodePos(file, n).Errorf("Parse error reading %s: expected a string", what)
+	}
+	return n.Value, nil
+}
+
+func (bt *buildTarget) setBase(file string, n *yaml.Node) error {
+	base, err := scalarValue(file, n, "base")
+	if err != nil {
+		return err
 	}
 	if bt.base != "" {
-		return fmt.Errorf("Duplicate base for %s", bt.target)
+		return nodePos(file, n).Errorf("Duplicate base for %s", bt.target)
 	}
-	bt.base = i.(string)
+	bt.base = base
 	return nil
 }
 
-func (bt *buildTarget) appendRun(i interface{}) error {
-	switch i.(type) {
-	case string:
-		bt.run = append(bt.run, i.(string))
-	case []interface{}:
-		for _, e := range i.([]interface{}) {
-			switch e.(type) {
-			case string:
-				bt.run = append(bt.run, e.(string))
-			default:
-				return fmt.Errorf("Parse error at run step for %s", bt.target)
-			}
+// Append kind steps for n, which is either a single step or a list of
+// them.
+func (bt *buildTarget) appendSteps(kind string, file string, n *yaml.Node) error {
+	nodes := []*yaml.Node{n}
+	if n.Kind == yaml.SequenceNode {
+		nodes = n.Content
+	}
+	for _, e := range nodes {
+		step, err := parseStep(kind, file, e)
+		if err != nil {
+			return err
 		}
-	default:
-		return fmt.Errorf("Parse error at run step for %s", bt.target)
+		bt.steps = append(bt.steps, step)
 	}
 	return nil
 }
 
-func (bt *buildTarget) appendInstall(i interface{}) error {
-	switch i.(type) {
-	case string:
-		bt.install = append(bt.install, i.(string))
-	case []interface{}:
-		for _, e := range i.([]interface{}) {
-			switch e.(type) {
-			case string:
-				bt.install = append(bt.install, e.(string))
-			default:
-				return fmt.Errorf("Parse error at install step for %s", bt.target)
+// Parse a single step.  Steps are strings, except that expand and
+// install steps may also be maps.  An expand map gives the archive as
+// src and the digest it must have; an install map gives the files to
+// install as src, and optionally their dest, mode, owner and group:
+//   expand:
+//     - src: file:///srv/vendor/rootfs.tar.xz
+//       digest: sha256:...
+//   install:
+//     - src: bin/*
+//       dest: /usr/local/bin/
+//       mode: 0755
+//       owner: root
+func parseStep(kind string, file string, n *yaml.Node) (buildStep, error) {
+	step := buildStep{kind: kind, pos: nodePos(file, n)}
+	if n.Kind != yaml.MappingNode || kind == "run" {
+		arg, err := scalarValue(file, n, kind+" step")
+		step.arg = arg
+		return step, err
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		val, err := scalarValue(file, v, kind+" "+k.Value)
+		if err != nil {
+			return step, err
+		}
+		switch {
+		case k.Value == "src":
+			step.arg = val
+		case k.Value == "digest" && kind == "expand":
+			if !sha256Digest.MatchString(val) {
+				return step, nodePos(file, v).Errorf("Bad digest %s: expected sha256:<hex>", val)
+			}
+			step.digest = val
+		case k.Value == "dest" && kind == "install":
+			step.install.dest = val
+		case k.Value == "mode" && kind == "install":
+			if m, err := strconv.ParseUint(val, 8, 32); err != nil || m > 07777 {
+				return step, nodePos(file, v).Errorf("Bad mode %s: expected octal permissions", val)
 			}
+			step.install.mode = val
+		case k.Value == "owner" && kind == "install":
+			step.install.owner = val
+		case k.Value == "group" && kind == "install":
+			step.install.group = val
+		default:
+			return step, nodePos(file, k).Errorf("Unknown %s key %s", kind, k.Value)
 		}
-	default:
-		return fmt.Errorf("Parse error at install step for %s", bt.target)
 	}
-	return nil
+	if step.arg == "" {
+		return step, step.pos.Errorf("No src for %s step", kind)
+	}
+	return step, nil
 }
 
-func (bt *buildTarget) appendExpand(i interface{}) error {
-	switch i.(type) {
-	case string:
-		bt.expand = append(bt.expand, i.(string))
-	case []interface{}:
-		for _, e := range i.([]interface{}) {
-			switch e.(type) {
-			case string:
-				bt.expand = append(bt.expand, e.(string))
-			default:
-				return fmt.Errorf("Parse error at expand step for %s", bt.target)
+// Resolve a path named in a recipe relative to the recipe's directory.
+func recipePath(recipeDir, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(recipeDir, p)
+}
+
+// Run a command, returning its trimmed stdout, or an error including
+// its stderr.
+func runCaptured(name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Apply the target's run, install and expand steps to the rootfs at
+// rootfs, in the order they appear in the recipe.  The steps' output
+// goes to out.
+func (bt *buildTarget) Apply(rootfs, recipeDir string, out io.Writer) error {
+	for _, s := range bt.steps {
+		var err error
+		switch s.kind {
+		case "expand":
+			var src string
+			if src, err = expandSource(recipeDir, s.arg); err == nil {
+				err = expandArchive(src, s.digest, rootfs)
 			}
+		case "install":
+			err = installFiles(recipeDir, s.arg, s.install, rootfs)
+		case "run":
+			err = runInChroot(rootfs, []string{"/bin/sh", "-c", s.arg}, nil, out, out)
+		}
+		if err != nil {
+			return s.pos.Errorf("Failed at %s step '%s': %v", s.kind, s.arg, err)
 		}
-	default:
-		return fmt.Errorf("Parse error at expand step for %s", bt.target)
 	}
 	return nil
 }
 
-func (bt *buildTarget) setCmd(i interface{}) error {
-	switch i.(type) {
-	case string:
-	default:
-		return fmt.Errorf("Parse error reading entrypoint at %s", bt.target)
+func readRecipe(file string) (*buildRecipe, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening recipe file %s: %v", file, err)
 	}
-	bt.entrypoint = i.(string)
-	return nil
+	recipe, err := parseRecipe(file, contents)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing recipe: %v", err)
+	}
+	return recipe, nil
 }
 
 // Parse a recipe that looks like:
@@ -149,51 +350,60 @@ func (bt *buildTarget) setCmd(i interface{}) error {
 // target2:
 //   base: target1
 //   run: echo hw > /helloworld
-func parseRecipe(contents []byte) (r *buildRecipe, err error) {
-	var i interface{}
-	r = &buildRecipe{}
-	err = yaml.Unmarshal(contents, &i)
-	if err != nil {
-		return
+//
+// Targets and steps keep the order they have in the file.  Errors are
+// prefixed with file:line:col of the offending node.
+func parseRecipe(file string, contents []byte) (*buildRecipe, error) {
+	var doc yaml.Node
+	r := &buildRecipe{}
+	if err := yaml.Unmarshal(contents, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
 	}
-	m := i.(map[interface{}] interface{})
-	for k, v := range m {
-		switch k.(type) {
-		case string:
-		default:
-			err = fmt.Errorf("Parser error")
-			return
+	if len(doc.Content) == 0 {
+		return nil, fmt.Errorf("%s: Empty recipe", file)
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nodePos(file, root).Errorf("Parser error: expected a map of targets")
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i], root.Content[i+1]
+		name, err := scalarValue(file, k, "target name")
+		if err != nil {
+			return nil, err
 		}
-		bt := buildTarget{ target: k.(string) }
-		step := v.(map[interface{}]interface{})
-		for s, t := range step {
-			switch s.(type) {
-			case string:
-			default:
-				err = fmt.Errorf("Parse error at %s", bt.target)
-				return
+		if r.HasTarget(name) {
+			return nil, nodePos(file, k).Errorf("Duplicate target %s", name)
+		}
+		bt := buildTarget{target: name, pos: nodePos(file, k)}
+		if v.Kind != yaml.MappingNode {
+			return nil, nodePos(file, v).Errorf("Parse error at %s", bt.target)
+		}
+		for j := 0; j+1 < len(v.Content); j += 2 {
+			s, t := v.Content[j], v.Content[j+1]
+			ss, err := scalarValue(file, s, "keyword")
+			if err != nil {
+				return nil, err
 			}
-			ss := s.(string)
 			switch ss {
 			case "base":
-				err = bt.setBase(t)
-			case "run":
-				err = bt.appendRun(t)
-			case "install":
-				err = bt.appendInstall(t)
-			case "expand":
-				err = bt.appendExpand(t)
-			case "entrypoint", "cmd":
-				err = bt.setCmd(t)
+				err = bt.setBase(file, t)
+			case "run", "install", "expand":
+				err = bt.appendSteps(ss, file, t)
+			case "annotations":
+				err = bt.setAnnotations(file, s, t)
 			default:
-				err = fmt.Errorf("Parser error at %s: unknown keyword %s", bt.target, ss)
+				if set, ok := imageConfigKeywords[ss]; ok {
+					err = set(&bt.imageSettings, file, s, t)
+				} else {
+					err = nodePos(file, s).Errorf("Parser error at %s: unknown keyword %s", bt.target, ss)
+				}
 			}
 			if err != nil {
-				return
+				return nil, err
 			}
 		}
 		r.Targets = append(r.Targets, bt)
 	}
-	return
+	return r, nil
 }
-
@@ -0,0 +1,212 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Check that err is an error starting with prefix, or nil if prefix is "".
+func checkError(t *testing.T, what string, err error, prefix string) {
+	t.Helper()
+	switch {
+	case prefix == "" && err != nil:
+		t.Errorf("%s: %v", what, err)
+	case prefix != "" && err == nil:
+		t.Errorf("%s: no error, wanted %s...", what, prefix)
+	case prefix != "" && !strings.HasPrefix(err.Error(), prefix):
+		t.Errorf("%s: got error %q, wanted %s...", what, err, prefix)
+	}
+}
+
+func TestParseRecipe(t *testing.T) {
+	tests := []struct {
+		what   string
+		recipe string
+		err    string
+	}{
+		{"empty", "", "r.yaml: Empty recipe"},
+		{"not a map", "- a\n", "r.yaml:1:1: Parser error"},
+		{"target not a map", "a: b\n", "r.yaml:1:4: Parse error at a"},
+		{"unknown keyword", "a:\n  base: empty\n  frob: x\n", "r.yaml:3:3: Parser error at a: unknown keyword frob"},
+		{"duplicate target", "a:\n  base: empty\na:\n  base: empty\n", "r.yaml:3:1: Duplicate target a"},
+		{"duplicate base", "a:\n  base: empty\n  base: b\n", "r.yaml:3:9: Duplicate base for a"},
+		{"list base", "a:\n  base: [b]\n", "r.yaml:2:9: Parse error reading base"},
+		{"null step", "a:\n  base: empty\n  run:\n    - ls\n    -\n", "r.yaml:5:6: Parse error reading run step"},
+		{"run map", "a:\n  base: empty\n  run: {src: x}\n", "r.yaml:3:8: Parse error reading run step"},
+		{"expand bad digest", "a:\n  base: empty\n  expand:\n    src: x.tar\n    digest: md5:0\n", "r.yaml:5:13: Bad digest md5:0"},
+		{"expand no src", "a:\n  base: empty\n  expand:\n    digest: sha256:" + strings.Repeat("0", 64) + "\n", "r.yaml:4:5: No src for expand step"},
+		{"install bad mode", "a:\n  base: empty\n  install:\n    - src: x\n      mode: 0999\n", "r.yaml:5:13: Bad mode 0999"},
+		{"install unknown key", "a:\n  base: empty\n  install:\n    src: x\n    digest: y\n", "r.yaml:5:5: Unknown install key digest"},
+		{"good", "a:\n  base: empty\n  run: ls\nb:\n  base: a\n  install:\n    - x\n    - src: y\n      dest: /y\n", ""},
+	}
+	for _, test := range tests {
+		_, err := parseRecipe("r.yaml", []byte(test.recipe))
+		checkError(t, test.what, err, test.err)
+	}
+}
+
+func TestParseRecipeSteps(t *testing.T) {
+	recipe := `
+a:
+  base: empty
+  run: one
+  install:
+    - bin/*
+    - src: etc/conf
+      dest: /etc/
+      mode: 0600
+      owner: root
+  expand:
+    src: rootfs.tar
+  run:
+    - two
+    - three
+`
+	r, err := parseRecipe("r.yaml", []byte(recipe))
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []string{}
+	for _, s := range r.Targets[0].steps {
+		steps = append(steps, fmt.Sprintf("%s %s %s %s %s", s.kind, s.arg, s.install.dest, s.install.mode, s.install.owner))
+	}
+	want := []string{
+		"run one   ",
+		"install bin/*   ",
+		"install etc/conf /etc/ 0600 root",
+		"expand rootfs.tar   ",
+		"run two   ",
+		"run three   ",
+	}
+	if strings.Join(steps, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got steps\n%s\nwanted\n%s", strings.Join(steps, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// Return the names of targets, in order.
+func targetNames(targets []buildTarget) string {
+	names := []string{}
+	for _, t := range targets {
+		names = append(names, t.target)
+	}
+	return strings.Join(names, " ")
+}
+
+// Return a recipe with the given targets, each "name:base".
+func testRecipe(targets ...string) *buildRecipe {
+	r := &buildRecipe{}
+	for i, tb := range targets {
+		nb := strings.SplitN(tb, ":", 2)
+		r.Targets = append(r.Targets, buildTarget{
+			target: nb[0],
+			base:   nb[1],
+			steps:  []buildStep{{kind: "run", arg: "true"}},
+			pos:    recipePos{file: "r.yaml", line: i + 1, col: 1},
+		})
+	}
+	return r
+}
+
+func TestBuildOrder(t *testing.T) {
+	tests := []struct {
+		targets []string
+		want    string
+		err     string
+	}{
+		{[]string{"a:empty", "b:a", "c:b"}, "a b c", ""},
+		{[]string{"c:b", "b:a", "a:empty"}, "a b c", ""},
+		{[]string{"b:a", "x:tag", "a:empty", "y:x"}, "a b x y", ""},
+		{[]string{"a:a"}, "", "r.yaml:1:1: Dependency cycle: a -> a"},
+		{[]string{"a:b", "b:c", "c:a"}, "", "r.yaml:1:1: Dependency cycle: a -> b -> c -> a"},
+		{[]string{"x:empty", "a:b", "b:a"}, "", "r.yaml:2:1: Dependency cycle: a -> b -> a"},
+		{[]string{"x:a", "a:b", "b:a"}, "", "r.yaml:2:1: Dependency cycle: a -> b -> a"},
+	}
+	for _, test := range tests {
+		what := strings.Join(test.targets, " ")
+		order, err := testRecipe(test.targets...).BuildOrder()
+		checkError(t, what, err, test.err)
+		if err == nil && targetNames(order) != test.want {
+			t.Errorf("%s: got order %s, wanted %s", what, targetNames(order), test.want)
+		}
+	}
+}
+
+func TestSubset(t *testing.T) {
+	r := testRecipe("a:empty", "b:a", "c:b", "d:a", "e:tag")
+	tests := []struct {
+		names    []string
+		depsOnly bool
+		want     string
+		err      string
+	}{
+		{[]string{"c"}, false, "a b c", ""},
+		{[]string{"c"}, true, "a b", ""},
+		{[]string{"d", "e"}, false, "a d e", ""},
+		{[]string{"a"}, true, "", ""},
+		// b is needed by c, so it is built even though only its
+		// dependencies were asked for.
+		{[]string{"b", "c"}, true, "a b", ""},
+		{[]string{"z"}, false, "", "No target z in recipe"},
+	}
+	for _, test := range tests {
+		what := fmt.Sprintf("%v (deps only %v)", test.names, test.depsOnly)
+		sub, err := r.Subset(test.names, test.depsOnly)
+		checkError(t, what, err, test.err)
+		if err == nil && targetNames(sub.Targets) != test.want {
+			t.Errorf("%s: got %s, wanted %s", what, targetNames(sub.Targets), test.want)
+		}
+	}
+}
+
+func TestSanityCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker-sanity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// No OCI layout, so no tags exist.
+	c := &stackerConfig{OciDir: filepath.Join(dir, "oci")}
+
+	noWork := testRecipe("a:empty")
+	noWork.Targets[0].steps = nil
+	configOnly := testRecipe("a:empty")
+	configOnly.Targets[0].steps = nil
+	configOnly.Targets[0].cmd = []string{"true"}
+	annotationsOnly := testRecipe("a:empty")
+	annotationsOnly.Targets[0].steps = nil
+	annotationsOnly.Targets[0].annotations = map[string]string{}
+
+	tests := []struct {
+		what   string
+		recipe *buildRecipe
+		err    string
+	}{
+		{"good", testRecipe("a:empty", "b:a"), ""},
+		{"no base", testRecipe("a:"), "r.yaml:1:1: No base defined for target a"},
+		{"unknown base", testRecipe("a:empty", "b:nope"), "r.yaml:2:1: Nonexistent base for target b: nope"},
+		{"no work", noWork, "r.yaml:1:1: No work for target: a"},
+		{"config only", configOnly, ""},
+		{"annotations only", annotationsOnly, ""},
+	}
+	for _, test := range tests {
+		checkError(t, test.what, test.recipe.SanityCheck(c), test.err)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// The build cache maps the inputs of a target (its base image, its
+// steps, and the contents of the files its steps read) to the image it
+// was built into, so a target whose inputs have not changed is simply
+// re-tagged instead of rebuilt.
+type cacheEntry struct {
+	Target   string           `json:"target"`
+	Manifest ispec.Descriptor `json:"manifest"`
+	Created  time.Time        `json:"created"`
+}
+
+type buildCache struct {
+	Entries map[string]cacheEntry `json:"entries"`
+	path    string
+	// Parallel builds share the cache.
+	mu sync.Mutex
+}
+
+func (c *stackerConfig) buildCachePath() string {
+	return filepath.Join(c.stateDir(), "build-cache.json")
+}
+
+func (c *stackerConfig) loadBuildCache() (*buildCache, error) {
+	cache := &buildCache{Entries: map[string]cacheEntry{}, path: c.buildCachePath()}
+	contents, err := ioutil.ReadFile(cache.path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, cache); err != nil {
+		return nil, fmt.Errorf("Corrupt build cache %s: %v", cache.path, err)
+	}
+	if cache.Entries == nil {
+		cache.Entries = map[string]cacheEntry{}
+	}
+	return cache, nil
+}
+
+func (bc *buildCache) Save() error {
+	if err := os.MkdirAll(filepath.Dir(bc.path), 0755); err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(bc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(bc.path, contents)
+}
+
+// Hash the file or tree at path: names, types, modes, ownership,
+// symlink targets and file contents.  Timestamps are left out, so a
+// fresh checkout of the same files hashes the same.
+func hashInput(path string) (string, error) {
+	h := sha256.New()
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		uid, gid := uint32(0), uint32(0)
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			uid, gid = st.Uid, st.Gid
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00%d:%d\x00", rel, fi.Mode(), uid, gid)
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00", target)
+		case fi.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err := io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hash every file an install step's src glob matches, and their names.
+func hashInstallSources(recipeDir, src string) (string, error) {
+	sources, err := installSources(recipeDir, src)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, s := range sources {
+		sum, err := hashInput(s)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%s\x00", filepath.Base(s), sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Hash the archive an expand step extracts.  The archive is opened
+// following symlinks, so if it is one, it is what it points at that
+// matters.
+func hashExpandSource(recipeDir, src string) (string, error) {
+	path, err := expandSource(recipeDir, src)
+	if err != nil {
+		return "", err
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	return hashInput(path)
+}
+
+// Everything which determines what a target builds into.
+type cacheInputs struct {
+	Base string `json:"base"`
+	// The ref name annotation.
+	Target     string            `json:"target"`
+	Steps      []cacheStep       `json:"steps"`
+	Entrypoint []string          `json:"entrypoint"`
+	Cmd        []string          `json:"cmd"`
+	Env        []string          `json:"env"`
+	Labels     map[string]string `json:"labels"`
+	User       string            `json:"user"`
+	Workdir    string            `json:"workdir"`
+	Volumes    []string          `json:"volumes"`
+	Ports      []string          `json:"ports"`
+	StopSignal string            `json:"stopsignal"`
+	// Annotations set by the recipe; the ones stacker works out are
+	// left as they were when the cached image was built.
+	Annotations map[string]string `json:"annotations"`
+	Files       map[string]string `json:"files"`
+}
+
+type cacheStep struct {
+	Kind   string `json:"kind"`
+	Arg    string `json:"arg"`
+	Digest string `json:"digest,omitempty"`
+	Dest   string `json:"dest,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	Group  string `json:"group,omitempty"`
+}
+
+// Return what t is built on top of for the purposes of the cache: the
+// digest of its base image, or "empty".  The base must already exist.
+func (c *stackerConfig) cacheBase(t *buildTarget) (string, error) {
+	if t.base == "empty" {
+		return "empty", nil
+	}
+	desc, err := c.GetTagDigest(t.base)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest.String(), nil
+}
+
+// Return the cache key for t built on base (as returned by cacheBase).
+func buildCacheKey(t *buildTarget, base string, recipeDir string) (string, error) {
+	in := cacheInputs{
+		Base:        base,
+		Target:      t.target,
+		Entrypoint:  t.entrypoint,
+		Cmd:         t.cmd,
+		Env:         t.env,
+		Labels:      t.labels,
+		User:        t.user,
+		Workdir:     t.workdir,
+		Volumes:     t.volumes,
+		Ports:       t.ports,
+		StopSignal:  t.stopSignal,
+		Annotations: t.annotations,
+		Files:       map[string]string{},
+	}
+	for _, s := range t.steps {
+		in.Steps = append(in.Steps, cacheStep{
+			Kind:   s.kind,
+			Arg:    s.arg,
+			Digest: s.digest,
+			Dest:   s.install.dest,
+			Mode:   s.install.mode,
+			Owner:  s.install.owner,
+			Group:  s.install.group,
+		})
+		var sum string
+		var err error
+		switch {
+		case s.kind == "install":
+			sum, err = hashInstallSources(recipeDir, s.arg)
+		case s.kind == "expand" && s.digest == "":
+			// Archives with a digest are checked against it by the
+			// build, so the digest in the step is enough.
+			sum, err = hashExpandSource(recipeDir, s.arg)
+		default:
+			continue
+		}
+		if err != nil {
+			return "", s.pos.Errorf("Failed hashing %s: %v", s.arg, err)
+		}
+		in.Files[s.arg] = sum
+	}
+	contents, err := json.Marshal(in)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Return the image the cache has for key, if it is still in the OCI
+// layout.  If prune is set, an entry whose image has been garbage
+// collected is dropped from the cache.
+func (c *stackerConfig) cachedImage(bc *buildCache, key string, prune bool) (ispec.Descriptor, bool) {
+	bc.mu.Lock()
+	entry, ok := bc.Entries[key]
+	bc.mu.Unlock()
+	if !ok {
+		return ispec.Descriptor{}, false
+	}
+	engine, err := openOCI(c.OciDir)
+	if err != nil {
+		return ispec.Descriptor{}, false
+	}
+	defer engine.Close()
+
+	if _, err := readManifest(context.Background(), engine, entry.Manifest); err != nil {
+		// The image has been garbage collected.
+		if prune {
+			bc.mu.Lock()
+			delete(bc.Entries, key)
+			bc.mu.Unlock()
+		}
+		return ispec.Descriptor{}, false
+	}
+	return entry.Manifest, true
+}
+
+// If the cache has an image for key, point t's tag at it and return
+// true.  The image is used exactly as it was built, annotations and
+// all, so that targets built on t hit the cache too.
+func (c *stackerConfig) useCached(bc *buildCache, key string, t *buildTarget) (bool, error) {
+	desc, ok := c.cachedImage(bc, key, true)
+	if !ok {
+		return false, nil
+	}
+
+	lock, err := c.LockOciDir()
+	if err != nil {
+		return false, err
+	}
+	defer lock.Unlock()
+	engine, err := openOCI(c.OciDir)
+	if err != nil {
+		return false, err
+	}
+	defer engine.Close()
+	if err := engine.UpdateReference(context.Background(), t.target, desc); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Remember that key built t into whatever its tag now points at.  The
+// descriptor is stored as the index has it, with its annotations.
+func (c *stackerConfig) cacheBuilt(bc *buildCache, key string, t *buildTarget) error {
+	desc, err := c.GetTagDigest(t.target)
+	if err != nil {
+		return err
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.Entries[key] = cacheEntry{Target: t.target, Manifest: desc, Created: time.Now()}
+	return bc.Save()
+}
+
+func (c *stackerConfig) CacheList() error {
+	bc, err := c.loadBuildCache()
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	for k := range bc.Entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bc.Entries[keys[i]].Created.Before(bc.Entries[keys[j]].Created)
+	})
+	for _, k := range keys {
+		e := bc.Entries[k]
+		fmt.Printf("%s %s %s %s\n", k[:12], e.Created.Format(time.RFC3339), e.Manifest.Digest, e.Target)
+	}
+	return nil
+}
+
+// Drop cache entries for images no tag points at any more, or every
+// entry if all is set.
+func (c *stackerConfig) CachePrune(all bool) error {
+	bc, err := c.loadBuildCache()
+	if err != nil {
+		return err
+	}
+	live := map[string]bool{}
+	if !all {
+		tags, err := c.ListTags()
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if desc, err := c.GetTagDigest(tag); err == nil {
+				live[desc.Digest.String()] = true
+			}
+		}
+	}
+	for k, e := range bc.Entries {
+		if !live[e.Manifest.Digest.String()] {
+			delete(bc.Entries, k)
+		}
+	}
+	return bc.Save()
+}
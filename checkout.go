@@ -0,0 +1,239 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// The record of the current checkout, kept in stackerStateDir.  It is
+// written before the driver starts checking out, so a checkout which
+// was interrupted can still be found and cleaned up.
+//
+// PID is the process working on the checkout: it is set while a
+// checkout, checkin or build is in progress, and zero while the checkout
+// is simply waiting for the user.  A record whose PID is no longer
+// running was left behind by a killed process.  PIDStart is when that
+// process started (see processStartTime), so that another process which
+// has since been given the same PID isn't mistaken for it.
+type checkoutRecord struct {
+	Driver   string             `json:"driver"`
+	Tag      string             `json:"tag"`
+	Manifest ispec.Descriptor   `json:"manifest"`
+	Layers   []ispec.Descriptor `json:"layers"`
+	Started  time.Time          `json:"started"`
+	PID      int                `json:"pid"`
+	PIDStart uint64             `json:"pid_start,omitempty"`
+}
+
+func (c *stackerConfig) stateDir() string {
+	return filepath.Join(c.BaseDir, ".stacker")
+}
+
+func (c *stackerConfig) checkoutRecordPath() string {
+	return filepath.Join(c.stateDir(), "checkout"+c.checkoutSuffix()+".json")
+}
+
+// Parallel builds give each target its own checkout area, named by
+// appending this to the usual checkout directory, dataset or LV name.
+func (c *stackerConfig) checkoutSuffix() string {
+	if c.checkoutName == "" {
+		return ""
+	}
+	return "-" + c.checkoutName
+}
+
+// Write contents to path, replacing any existing file atomically: a
+// reader sees either the old contents or all of the new.
+func writeFileAtomic(path string, contents []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(contents); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Write rec, replacing any existing record atomically.
+func (c *stackerConfig) writeCheckoutRecord(rec *checkoutRecord) error {
+	if err := os.MkdirAll(c.stateDir(), 0755); err != nil {
+		return err
+	}
+	contents, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.checkoutRecordPath(), contents)
+}
+
+// Read the checkout record, returning nil if there is none.
+func (c *stackerConfig) readCheckoutRecord() (*checkoutRecord, error) {
+	return readCheckoutRecordFile(c.checkoutRecordPath())
+}
+
+func readCheckoutRecordFile(path string) (*checkoutRecord, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rec := &checkoutRecord{}
+	if err := json.Unmarshal(contents, rec); err != nil {
+		return nil, fmt.Errorf("Corrupt checkout record %s: %v", path, err)
+	}
+	return rec, nil
+}
+
+// Return the records of every checkout in BaseDir, the parallel builds'
+// included.
+func (c *stackerConfig) checkoutRecords() ([]*checkoutRecord, error) {
+	paths, err := filepath.Glob(filepath.Join(c.stateDir(), "checkout*.json"))
+	if err != nil {
+		return nil, err
+	}
+	recs := []*checkoutRecord{}
+	for _, p := range paths {
+		rec, err := readCheckoutRecordFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+func (c *stackerConfig) removeCheckoutRecord() error {
+	err := os.Remove(c.checkoutRecordPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Build the record for a checkout of tag by this process.
+func (c *stackerConfig) newCheckoutRecord(tag string) (*checkoutRecord, error) {
+	engine, err := openOCI(c.OciDir)
+	if err != nil {
+		return nil, err
+	}
+	defer engine.Close()
+
+	desc, manifest, err := tagManifest(context.Background(), engine, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &checkoutRecord{
+		Driver:   c.FsType,
+		Tag:      tag,
+		Manifest: desc,
+		Layers:   manifest.Layers,
+		Started:  time.Now(),
+		PID:      os.Getpid(),
+		PIDStart: processStartTime(os.Getpid()),
+	}, nil
+}
+
+// Mark the checkout as being worked on by this process (or, with pid 0,
+// by nobody).
+func (c *stackerConfig) claimCheckout(rec *checkoutRecord, pid int) error {
+	rec.PID = pid
+	rec.PIDStart = 0
+	if pid != 0 {
+		rec.PIDStart = processStartTime(pid)
+	}
+	return c.writeCheckoutRecord(rec)
+}
+
+// Return when process pid started, in clock ticks since boot (field 22
+// of /proc/<pid>/stat), or 0 if it isn't running.
+func processStartTime(pid int) uint64 {
+	contents, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// The command name (field 2) is in parentheses and may contain
+	// spaces, so count fields from the end of it.
+	stat := string(contents)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 20 {
+		return 0
+	}
+	start, _ := strconv.ParseUint(fields[19], 10, 64)
+	return start
+}
+
+// Whether process pid, which started at start, is still running.  A
+// start of 0 (from a record written before start times were kept)
+// matches any process with that PID.
+func processAlive(pid int, start uint64) bool {
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+		return false
+	}
+	return start == 0 || processStartTime(pid) == start
+}
+
+// Whether the record was written by this very process.
+func (rec *checkoutRecord) ours() bool {
+	return rec.PID == os.Getpid() && (rec.PIDStart == 0 || rec.PIDStart == processStartTime(os.Getpid()))
+}
+
+// Whether the record was left behind by a process which died while
+// working on the checkout.
+func (rec *checkoutRecord) Stale() bool {
+	return rec.PID != 0 && !rec.ours() && !processAlive(rec.PID, rec.PIDStart)
+}
+
+// Whether another live process is working on the checkout.
+func (rec *checkoutRecord) Busy() bool {
+	return rec.PID != 0 && !rec.ours() && processAlive(rec.PID, rec.PIDStart)
+}
+
+// Return the image the current checkout was made from.  Checkouts made
+// before checkout records existed fall back to the bundle metadata.
+func (c *stackerConfig) checkoutParent(rec *checkoutRecord) (ispec.Descriptor, error) {
+	if rec != nil {
+		return rec.Manifest, nil
+	}
+	meta, err := readBundleMeta(c.UnpackDir())
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("No checkout record and no bundle metadata: %v", err)
+	}
+	return meta.From, nil
+}
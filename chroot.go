@@ -0,0 +1,165 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// Host directories bind-mounted into the rootfs for the duration of a
+// chroot.
+var chrootBindMounts = []string{"/proc", "/sys", "/dev"}
+
+// Return where path is inside rootfs, as resolvePath does, but following
+// path itself too if it is a symlink.  The rootfs itself is refused, so
+// nothing is ever mounted over it.
+func resolveChrootPath(rootfs string, path string) (string, error) {
+	// Resolve a path inside path, so that if it is a symlink we find
+	// where it points within the rootfs.
+	inside, err := resolvePath(rootfs, filepath.Join(path, "x"), true)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Dir(inside)
+	if dest == filepath.Clean(rootfs) {
+		return "", fmt.Errorf("%s resolves to the root", path)
+	}
+	return dest, nil
+}
+
+// Bind-mount a copy of the host's resolv.conf over the rootfs's, so
+// the rootfs's own file is never changed (and a killed stacker can't leave
+// the host's behind in the image).  The copy means writes in the chroot
+// don't reach the host's.  If the image has no resolv.conf, an empty one
+// is created to mount over.  Return the mount, and a function to call
+// once it is unmounted, which removes the copy and any empty file.
+func setupResolvConf(rootfs string) (string, func(), error) {
+	contents, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return "", nil, err
+	}
+	dest, err := resolveChrootPath(rootfs, "etc/resolv.conf")
+	if err != nil {
+		return "", nil, err
+	}
+
+	created := false
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return "", nil, err
+		}
+		if err := ioutil.WriteFile(dest, nil, 0644); err != nil {
+			return "", nil, err
+		}
+		created = true
+	}
+
+	copied, err := ioutil.TempFile("", "stacker-resolv.conf")
+	cleanup := func() {
+		if copied != nil {
+			os.Remove(copied.Name())
+		}
+		if created {
+			os.Remove(dest)
+		}
+	}
+	if err == nil {
+		_, err = copied.Write(contents)
+		if cerr := copied.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = os.Chmod(copied.Name(), 0644)
+	}
+	if err == nil {
+		err = syscall.Mount(copied.Name(), dest, "", syscall.MS_BIND, "")
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dest, cleanup, nil
+}
+
+// Run args (or a shell if args is empty) chrooted into rootfs, with
+// /proc, /sys and /dev bind-mounted from the host.  All mounts are torn
+// down again before returning, whether or not the command succeeded.
+func RunInChroot(rootfs string, args []string) error {
+	return runInChroot(rootfs, args, os.Stdin, os.Stdout, os.Stderr)
+}
+
+func runInChroot(rootfs string, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (err error) {
+	if !dirExists(rootfs) {
+		return fmt.Errorf("%s does not exist, nothing checked out?", rootfs)
+	}
+
+	mounted := []string{}
+	var cleanup func()
+	defer func() {
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if uerr := syscall.Unmount(mounted[i], syscall.MNT_DETACH); uerr != nil && err == nil {
+				err = fmt.Errorf("Failed unmounting %s: %v", mounted[i], uerr)
+			}
+		}
+		if cleanup != nil {
+			cleanup()
+		}
+	}()
+
+	for _, m := range chrootBindMounts {
+		// The image's /dev may be a symlink, so mount wherever it
+		// leads inside the rootfs.
+		dest, err := resolveChrootPath(rootfs, m)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(dest); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("Can't mount %s: %s is not a directory in the rootfs", m, m)
+		}
+		if err := syscall.Mount(m, dest, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("Failed bind mounting %s: %v", m, err)
+		}
+		mounted = append(mounted, dest)
+	}
+
+	var resolvConf string
+	if resolvConf, cleanup, err = setupResolvConf(rootfs); err != nil {
+		return fmt.Errorf("Failed mounting resolv.conf: %v", err)
+	}
+	mounted = append(mounted, resolvConf)
+
+	if len(args) == 0 {
+		args = []string{"/bin/sh"}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: rootfs}
+	cmd.Dir = "/"
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
@@ -16,25 +16,33 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-        "os/exec"
-        "strings"
+        "path/filepath"
+	"time"
 
 	"github.com/openSUSE/umoci/oci/cas/dir"
-	"github.com/openSUSE/umoci/oci/casext"
-	"gopkg.in/yaml.v2"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v3"
 	"golang.org/x/net/context"
 )
 
 type stackerConfig struct {
-	BaseDir	   string `yaml:"basedir"`
-	OciDir	   string `yaml:"ocidir"`
-	FsType     string `yaml:"fstype"`
-	LoFile     string `yaml:"lofile"`
-	BtrfsMount string `yaml:"btrfsmount"`
+	BaseDir     string `yaml:"basedir"`
+	OciDir      string `yaml:"ocidir"`
+	FsType      string `yaml:"fstype"`
+	LoFile      string `yaml:"lofile"`
+	BtrfsMount  string `yaml:"btrfsmount"`
+	ZfsPool     string `yaml:"zfspool"`
+	LvmVG       string `yaml:"lvmvg"`
+	LvmThinPool string `yaml:"lvmthinpool"`
+	LvmLVSize   string `yaml:"lvmlvsize"`
+	LockTimeout string `yaml:"locktimeout"`
+
+	// The name of the checkout area to use, when not the default one.
+	checkoutName string
 }
 
 func (c *stackerConfig) Initialize() error {
@@ -67,6 +75,20 @@ func (c *stackerConfig) Initialize() error {
 	if tmp.BaseDir != "" && tmp.FsType == "btrfs" && tmp.BtrfsMount == "" {
 		tmp.BtrfsMount = tmp.BaseDir + "/btrfs"
 	}
+	if tmp.FsType == "zfs" && tmp.ZfsPool == "" {
+		tmp.ZfsPool = "stacker"
+	}
+	if tmp.FsType == "lvm" {
+		if tmp.LvmVG == "" {
+			tmp.LvmVG = "stacker"
+		}
+		if tmp.LvmThinPool == "" {
+			tmp.LvmThinPool = "thinpool"
+		}
+		if tmp.LvmLVSize == "" {
+			tmp.LvmLVSize = "20G"
+		}
+	}
 
 	// Now copy it over
 	if tmp.BaseDir != "" {
@@ -76,6 +98,11 @@ func (c *stackerConfig) Initialize() error {
 		c.OciDir = tmp.OciDir
 	}
 	if tmp.FsType != "" {
+		if _, ok := storageDrivers[tmp.FsType]; !ok {
+			fmt.Fprintf(os.Stderr, "Error reading %s: unsupported fstype %s (supported: %v)\n",
+				fileName, tmp.FsType, storageTypes())
+			return fmt.Errorf("unsupported fstype %s", tmp.FsType)
+		}
 		c.FsType = tmp.FsType
 	}
 	if tmp.LoFile != "" {
@@ -84,6 +111,26 @@ func (c *stackerConfig) Initialize() error {
 	if tmp.BtrfsMount != "" {
 		c.BtrfsMount = tmp.BtrfsMount
 	}
+	if tmp.ZfsPool != "" {
+		c.ZfsPool = tmp.ZfsPool
+	}
+	if tmp.LvmVG != "" {
+		c.LvmVG = tmp.LvmVG
+	}
+	if tmp.LvmThinPool != "" {
+		c.LvmThinPool = tmp.LvmThinPool
+	}
+	if tmp.LvmLVSize != "" {
+		c.LvmLVSize = tmp.LvmLVSize
+	}
+	if tmp.LockTimeout != "" {
+		if _, err := time.ParseDuration(tmp.LockTimeout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s: bad locktimeout %s: %v\n",
+				fileName, tmp.LockTimeout, err)
+			return err
+		}
+		c.LockTimeout = tmp.LockTimeout
+	}
 	return nil
 }
 
@@ -91,100 +138,261 @@ func (config *stackerConfig) Show() {
 	fmt.Printf("basedir: %s\n", config.BaseDir)
 	fmt.Printf("ocidir: %s\n", config.OciDir)
 	fmt.Printf("fs driver: %s\n", config.FsType)
-	switch config.FsType {
-	case "btrfs":
-		if config.LoFile != "" {
-			fmt.Printf("  loopback file: %s\n", config.LoFile)
-			// TODO - detect whether it's created
-			fmt.Printf("  mountpoint: %s\n", config.BtrfsMount)
-			// TODO - detect whether it's mounted
-		}
-	case "zfs":
-		fmt.Printf("   Note zfs is not yet supported")
-	case "lvm":
-		fmt.Printf("   Note LVM is not yet supported")
-	default:
+	fmt.Printf("lock timeout: %s\n", config.LockTimeout)
+	if s, err := config.Storage(); err == nil {
+		s.Describe(os.Stdout)
 	}
 }
+
+// The directory holding the checked-out bundle.
 func (c *stackerConfig) UnpackDir() string {
-	switch c.FsType {
-	case "btrfs":
-		if c.BtrfsMount != "" {
-			return c.BtrfsMount + "/mounted"
-		}
-		return c.BaseDir + "/btrfs/mounted"
-	default:
-		return c.BaseDir + "/unpacked"
-	}
+	return filepath.Dir(c.RootfsDir())
 }
 
 func (c *stackerConfig) RootfsDir() string {
-	switch c.FsType {
-	case "btrfs":
-		if c.BtrfsMount != "" {
-			return c.BtrfsMount
+	s, err := c.Storage()
+	if err != nil {
+		return c.BaseDir + "/unpacked" + c.checkoutSuffix() + "/rootfs"
+	}
+	return s.RootfsPath()
+}
+
+type buildOptions struct {
+	// Rebuild every target, even those the build cache has.
+	noCache bool
+	// How many targets to build at once.
+	jobs int
+	// Build only these targets and what they are based on.
+	targets []string
+	// Build only what targets are based on.
+	depsOnly bool
+	// Print what would be built instead of building it.
+	dryRun bool
+}
+
+// Build a recipe
+func (c *stackerConfig) Build(buildFile string, opts buildOptions) error {
+	recipe, err := readRecipe(buildFile)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.targets) > 0 {
+		recipe, err = recipe.Subset(opts.targets, opts.depsOnly)
+		if err != nil {
+			return fmt.Errorf("Recipe error: %v", err)
 		}
-		return c.BaseDir + "/btrfs/mounted"
-	default:
-		return c.BaseDir + "/unpacked/rootfs"
 	}
+
+	if err := recipe.SanityCheck(c); err != nil {
+		return fmt.Errorf("Recipe error: %v", err)
+	}
+
+	order, err := recipe.BuildOrder()
+	if err != nil {
+		return fmt.Errorf("Recipe error: %v", err)
+	}
+
+	cache, err := c.loadBuildCache()
+	if err != nil {
+		return err
+	}
+
+	// Now follow the recipe
+	recipeDir := filepath.Dir(buildFile)
+	if opts.dryRun {
+		return c.printBuildPlan(order, recipe, recipeDir, cache, opts)
+	}
+	if opts.jobs > 1 {
+		return c.buildParallel(order, recipeDir, cache, opts)
+	}
+	for _, t := range order {
+		if err := c.buildCached(&t, recipeDir, cache, opts, os.Stdout); err != nil {
+			return fmt.Errorf("Error building %s: %v", t.target, err)
+		}
+	}
+
+	return nil
 }
 
-func alreadyBuilt(built []string, q string) bool {
-	for _, s := range built {
-		if q == s {
-			return true
+// Build t unless the build cache already has it, writing progress and
+// the output of t's steps to out.
+func (c *stackerConfig) buildCached(t *buildTarget, recipeDir string, cache *buildCache, opts buildOptions, out io.Writer) error {
+	base, err := c.cacheBase(t)
+	if err != nil {
+		return err
+	}
+	key, err := buildCacheKey(t, base, recipeDir)
+	if err != nil {
+		return err
+	}
+	if !opts.noCache {
+		hit, err := c.useCached(cache, key, t)
+		if err != nil {
+			return err
+		}
+		if hit {
+			fmt.Fprintf(out, "Using cached %s\n", t.target)
+			return nil
 		}
 	}
-	return false
+
+	fmt.Fprintf(out, "Building %s (base %s)\n", t.target, t.base)
+	if err := c.BuildTarget(t, recipeDir, out); err != nil {
+		return err
+	}
+	if err := c.cacheBuilt(cache, key, t); err != nil {
+		return fmt.Errorf("Failed updating build cache: %v", err)
+	}
+	return nil
 }
 
-// Build a recipe
-func (c *stackerConfig) Build(buildFile string) error {
-	contents, err := ioutil.ReadFile(buildFile)
+// Build a single target: check out its base, apply its steps to the
+// checked-out rootfs, and check the result in as a tag named after the
+// target.
+func (c *stackerConfig) BuildTarget(t *buildTarget, recipeDir string, out io.Writer) error {
+	if dirExists(c.UnpackDir()) {
+		return fmt.Errorf("%s is not empty, abort the current checkout first", c.UnpackDir())
+	}
+
+	baseDesc, err := c.baseImage(t)
 	if err != nil {
-		return fmt.Errorf("Error opening recipe file %s: %v", buildFile, err)
+		return err
+	}
+
+	base := t.base
+	if base == "empty" {
+		// Check out a scratch tag rather than t's own, which keeps
+		// pointing at its last good image unless the build succeeds.
+		base = "stacker-empty-" + t.target
+		if err := c.NewEmptyTag(base); err != nil {
+			return err
+		}
+		defer c.DeleteTag(base)
+	}
+	// Keep the checkout claimed until it is checked in, so that if the
+	// build is killed the checkout is recognizably stale.
+	if _, err := c.checkout(base); err != nil {
+		return fmt.Errorf("Failed checking out %s: %v", base, err)
+	}
+
+	if err := t.Apply(c.RootfsDir(), recipeDir, out); err != nil {
+		c.AbortCheckout(true)
+		return err
+	}
+
+	update := &imageUpdate{
+		config:      t.applyConfig,
+		annotations: imageAnnotations(t, recipeDir, baseDesc),
 	}
-	recipe, err := parseRecipe(contents)
+	if err := c.CheckinTag(t.target, update); err != nil {
+		c.AbortCheckout(true)
+		return err
+	}
+	return nil
+}
+
+// Return the image t is built on, or nil if it is built on empty.
+func (c *stackerConfig) baseImage(t *buildTarget) (*ispec.Descriptor, error) {
+	if t.base == "empty" {
+		return nil, nil
+	}
+	desc, err := c.GetTagDigest(t.base)
 	if err != nil {
-		return fmt.Errorf("Error parsing recipe: %v", err)
+		return nil, fmt.Errorf("Failed resolving %s: %v", t.base, err)
 	}
+	return &desc, nil
+}
 
-	if !recipe.SanityCheck(c) {
-		return fmt.Errorf("Recipe error (TODO show error details")
+// Create a tag pointing at an image with no layers, creating the OCI
+// layout first if needed.
+func (c *stackerConfig) NewEmptyTag(tag string) error {
+	lock, err := c.LockOciDir()
+	if err != nil {
+		return err
 	}
+	defer lock.Unlock()
 
-	// Now follow the recipe
-	deferred := recipe.Targets
-	built := []string{}
-	for len(deferred) != 0 {
-		targets := deferred
-		deferred = []buildTarget{}
-		// How do we want to report progress?
-		//fmt.Printf("Built: %v; targets: %v\n", built, targets)
-		for _, t := range targets {
-			if t.base != "empty" && !alreadyBuilt(built, t.base) && !c.OCITagExists(t.base) {
-				deferred = append(deferred, t)
-				continue
-			}
-			built = append(built, t.target)
+	if !dirExists(c.OciDir) {
+		if err := dir.Create(c.OciDir); err != nil {
+			return fmt.Errorf("Failed creating OCI layout %s: %v", c.OciDir, err)
 		}
 	}
+	engine, err := openOCI(c.OciDir)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
 
+	if err := newEmptyImage(context.Background(), engine, tag); err != nil {
+		return fmt.Errorf("Failed creating empty image %s: %v", tag, err)
+	}
 	return nil
 }
 
-// Note -if cmd/umoci/tag.go:tagList() did not take a cli.Contenxt,
-// then I could simply use that here.
-// I might give in and use urfave as well one day, but the point about
-// general re-usability remains
+func (c *stackerConfig) DeleteTag(tag string) error {
+	lock, err := c.LockOciDir()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	engine, err := openOCI(c.OciDir)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	return engine.DeleteReference(context.Background(), tag)
+}
+
+// Check in the checked-out rootfs as tag, applying update if it is set,
+// and clear the checkout.
+func (c *stackerConfig) CheckinTag(tag string, update *imageUpdate) error {
+	if !dirExists(c.UnpackDir()) {
+		return fmt.Errorf("Nothing checked out")
+	}
+	rec, err := c.readCheckoutRecord()
+	if err != nil {
+		return err
+	}
+	if rec != nil && rec.Busy() {
+		return fmt.Errorf("Checkout is in use by process %d", rec.PID)
+	}
+	from, err := c.checkoutParent(rec)
+	if err != nil {
+		return err
+	}
+	s, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	lock, err := c.LockOciDir()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if rec != nil {
+		if err := c.claimCheckout(rec, os.Getpid()); err != nil {
+			return fmt.Errorf("Failed updating checkout record: %v", err)
+		}
+	}
+	if err := s.Checkin(tag, from, update); err != nil {
+		if rec != nil {
+			c.claimCheckout(rec, 0)
+		}
+		return err
+	}
+	return c.removeCheckoutRecord()
+}
+
 func (c *stackerConfig) ListTags() ([]string, error) {
-	image, err := dir.Open(config.OciDir)
+	engine, err := openOCI(c.OciDir)
 	if err != nil {
 		return []string{}, err
 	}
-	engine := casext.NewEngine(image)
-	defer image.Close()
+	defer engine.Close()
 
 	names, err := engine.ListReferences(context.Background())
 	if err != nil {
@@ -208,24 +416,70 @@ func (c *stackerConfig) OCITagExists(q string) bool {
 }
 
 func (c *stackerConfig) CheckoutTag(tag string) bool {
-	if dirExists(c.UnpackDir()) {
-		fmt.Fprintf(os.Stderr, "%s is not empty\n", c.UnpackDir())
+	rec, err := c.checkout(tag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed checking out %s: %v\n", tag, err)
 		return false
 	}
-	switch c.FsType {
-	case "vfs":
-		return VfsExpandLayer(c.OciDir, tag, c.UnpackDir())
-	case "btrfs":
-		return btrfsClone(c, tag)
-	default:
-		fmt.Fprintf(os.Stderr, "Unsupported fs type")
+	if err := c.claimCheckout(rec, 0); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed updating checkout record: %v\n", err)
 		return false
 	}
 	return true
 }
 
+// Check out tag, recording the checkout as in progress by this process
+// before the driver starts.
+func (c *stackerConfig) checkout(tag string) (*checkoutRecord, error) {
+	old, err := c.readCheckoutRecord()
+	if err != nil {
+		return nil, err
+	}
+	if old != nil && old.Stale() {
+		return nil, fmt.Errorf("Checkout of %s was left behind by killed process %d, run abort first", old.Tag, old.PID)
+	} else if old != nil {
+		return nil, fmt.Errorf("%s is already checked out", old.Tag)
+	}
+	if dirExists(c.UnpackDir()) {
+		return nil, fmt.Errorf("%s is not empty", c.UnpackDir())
+	}
+	s, err := c.Storage()
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := c.newCheckoutRecord(tag)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.writeCheckoutRecord(rec); err != nil {
+		return nil, fmt.Errorf("Failed writing checkout record: %v", err)
+	}
+	// Drivers share unpacked images and layers between checkouts, so
+	// parallel builds take turns checking out.
+	checkoutMutex.Lock()
+	err = s.Checkout(tag)
+	checkoutMutex.Unlock()
+	if err != nil {
+		c.removeCheckoutRecord()
+		return nil, err
+	}
+	return rec, nil
+}
+
 func (c *stackerConfig) AbortCheckout(force bool) (failed bool, err error) {
+	rec, err := c.readCheckoutRecord()
+	if err != nil {
+		return true, err
+	}
+	if rec != nil && rec.Busy() {
+		return true, fmt.Errorf("Checkout is in use by process %d", rec.PID)
+	}
 	if !dirExists(c.UnpackDir()) {
+		if rec != nil {
+			// The checkout never got as far as creating anything.
+			return false, c.removeCheckoutRecord()
+		}
 		return false, fmt.Errorf("Nothing to abort")
 	}
 	if !force {
@@ -238,88 +492,73 @@ func (c *stackerConfig) AbortCheckout(force bool) (failed bool, err error) {
 		}
 	}
 
-	switch c.FsType {
-	case "vfs":
-		cmd := exec.Command("rm", "-rf", c.UnpackDir())  // Whoa
-		if err := cmd.Run(); err != nil {
-			return true, fmt.Errorf("Removal failed: %v", err)
-		}
-		return false, nil
-	default:
-		return true, fmt.Errorf("Unsupported fs type")
+	s, err := c.Storage()
+	if err != nil {
+		return true, err
+	}
+	if err := s.Abort(); err != nil {
+		return true, fmt.Errorf("Removal failed: %v", err)
+	}
+	if err := c.removeCheckoutRecord(); err != nil {
+		return true, err
 	}
 	return false, nil
 }
 
-// return the digest of all fs layers for tag, in order
-func (c stackerConfig)TagFsLayers(tag string) ([]string, error) {
-	image := fmt.Sprintf("%s:%s", c.OciDir, tag)
-	cmd := exec.Command("umoci", "stat", "--image", image)
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	retlines := []string{}
-	if err := cmd.Run(); err != nil {
-		return retlines, err
-	}
-	lines := strings.Split(buf.String(), "\n")
-	for _, line := range lines {
-		if line[0:7] == "sha256:" {
-			retlines = append(retlines, line[7:])
-		}
+// return the descriptors of all fs layers for tag, in order
+func (c *stackerConfig) TagFsLayers(tag string) ([]ispec.Descriptor, error) {
+	engine, err := openOCI(c.OciDir)
+	if err != nil {
+		return nil, err
 	}
-	return retlines, nil
-}
+	defer engine.Close()
 
-//
-// desired API functionality:
-// image, err := umoci.Open(c.OciDir, tag)
-// defer image.Close()
-// if err != nil {
-// 	return "", err
-// }
-// return image.Layers[image.NumLayers].Digest.Encoded(), nil
-func (c *stackerConfig) GetTagDigest(tag string) (string, error) {
-	image := fmt.Sprintf("%s:%s", c.OciDir, tag)
-	cmd := exec.Command("umoci", "stat", "--image", image)
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	if err := cmd.Run(); err != nil {
-		return "", err
-	}
-	lines := strings.Split(buf.String(), "\n")
-	for i := len(lines) - 1; i >= 0; i-- {
-		line := lines[i]
-		if line[0:7] == "sha256:" {
-			return line[7:], nil
-		}
+	_, manifest, err := tagManifest(context.Background(), engine, tag)
+	if err != nil {
+		return nil, err
 	}
-	return "", fmt.Errorf("not found")
+	return manifest.Layers, nil
 }
 
+// return the descriptor of the manifest tag points at
+func (c *stackerConfig) GetTagDigest(tag string) (ispec.Descriptor, error) {
+	engine, err := openOCI(c.OciDir)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer engine.Close()
+
+	return resolveTag(context.Background(), engine, tag)
+}
 
 func (c *stackerConfig) LoSetup() error {
-	switch c.FsType {
-	case "btrfs":
-		return btrfs_loSetup(c.LoFile, c.BtrfsMount)
-	default:
-		return fmt.Errorf("Loopback setup not supported for %s", c.FsType)
+	s, err := c.Storage()
+	if err != nil {
+		return err
 	}
+	return s.Setup()
 }
 
 func (c *stackerConfig) LoUnSetup() error {
-	switch c.FsType {
-	case "btrfs":
-		return btrfs_loUnsetup(c.LoFile, c.BtrfsMount)
-	default:
-		return fmt.Errorf("Loopback setup not supported for %s", c.FsType)
+	s, err := c.Storage()
+	if err != nil {
+		return err
 	}
+	return s.Teardown()
 }
 
 func (c *stackerConfig) Unpack() error {
-	switch c.FsType {
-	case "btrfs":
-		return btrfs_Unpack(c)
-	default:
-		return fmt.Errorf("CoW unpacking not supported for %s", c.FsType)
+	s, err := c.Storage()
+	if err != nil {
+		return err
+	}
+	return s.Unpack()
+}
+
+func (c *stackerConfig) GC() error {
+	s, err := c.Storage()
+	if err != nil {
+		return err
 	}
+	return s.GC()
 }
@@ -0,0 +1,231 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The "newc" cpio format, as written by cpio -H newc and used for
+// initramfs images: a 110 byte header of hex fields, the NUL-terminated
+// name and then the contents, each padded to four bytes.
+const (
+	cpioNewcMagic    = "070701"
+	cpioNewcCrcMagic = "070702"
+	cpioHeaderLen    = 110
+	cpioTrailer      = "TRAILER!!!"
+
+	// Linux's PATH_MAX, which bounds both names and symlink targets,
+	// so a bad header can't make us allocate gigabytes.
+	cpioMaxPath = 4096
+)
+
+type cpioInode struct {
+	dev uint64
+	ino uint64
+}
+
+type cpioEntry struct {
+	hdr  *tar.Header
+	data io.Reader
+}
+
+// Reads a newc cpio archive, presenting its entries as tar headers so
+// they can be extracted by extractArchive.
+//
+// In newc, the contents of a hard-linked file are stored with one of its
+// names, and the others are empty.  GNU cpio stores them with the last
+// name, but other writers use the first.  Empty names which come first
+// are held back until the contents turn up, and then follow them as hard
+// links; those which come after are hard links straight away.
+type cpioReader struct {
+	r       io.Reader
+	pending map[cpioInode][]*tar.Header
+	// The names hard-linked files' contents were stored with.
+	linked map[cpioInode]string
+	queue  []cpioEntry
+	// The contents of the archive entry last read, and its padding.
+	stream *io.LimitedReader
+	pad    int64
+	// What Read returns: the contents of the entry last returned by
+	// Next.
+	data io.Reader
+	done bool
+}
+
+func newCpioReader(r io.Reader) *cpioReader {
+	empty := bytes.NewReader(nil)
+	return &cpioReader{
+		r:       r,
+		pending: map[cpioInode][]*tar.Header{},
+		linked:  map[cpioInode]string{},
+		stream:  &io.LimitedReader{R: empty},
+		data:    empty,
+	}
+}
+
+func cpioPad(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+func (cr *cpioReader) Read(p []byte) (int, error) {
+	return cr.data.Read(p)
+}
+
+func (cr *cpioReader) Next() (*tar.Header, error) {
+	for len(cr.queue) == 0 {
+		if cr.done {
+			return nil, io.EOF
+		}
+		if err := cr.readEntry(); err != nil {
+			return nil, err
+		}
+	}
+	e := cr.queue[0]
+	cr.queue = cr.queue[1:]
+	cr.data = e.data
+	return e.hdr, nil
+}
+
+// Queue the held back names of hard-linked files whose contents never
+// turned up: the files were empty.
+func (cr *cpioReader) flushPending() {
+	for _, hdrs := range cr.pending {
+		cr.queue = append(cr.queue, cpioEntry{hdr: hdrs[0], data: bytes.NewReader(nil)})
+		for _, link := range hdrs[1:] {
+			link.Typeflag = tar.TypeLink
+			link.Linkname = hdrs[0].Name
+			cr.queue = append(cr.queue, cpioEntry{hdr: link, data: bytes.NewReader(nil)})
+		}
+	}
+	cr.pending = map[cpioInode][]*tar.Header{}
+}
+
+// Read the next entry of the archive onto the queue.
+func (cr *cpioReader) readEntry() error {
+	// Skip whatever the caller didn't read of the last entry.
+	if _, err := io.Copy(ioutil.Discard, cr.stream); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(ioutil.Discard, cr.r, cr.pad); err != nil || cr.stream.N > 0 {
+		return fmt.Errorf("Truncated cpio archive")
+	}
+
+	raw := make([]byte, cpioHeaderLen)
+	if _, err := io.ReadFull(cr.r, raw); err != nil {
+		return fmt.Errorf("Truncated cpio archive: %v", err)
+	}
+	magic := string(raw[:6])
+	if magic != cpioNewcMagic && magic != cpioNewcCrcMagic {
+		return fmt.Errorf("Unsupported cpio format (only newc is supported)")
+	}
+	fields := make([]uint64, 13)
+	for i := range fields {
+		v, err := strconv.ParseUint(string(raw[6+8*i:14+8*i]), 16, 32)
+		if err != nil {
+			return fmt.Errorf("Bad cpio header: %v", err)
+		}
+		fields[i] = v
+	}
+	ino, mode, uid, gid, nlink, mtime, size := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], int64(fields[6])
+	devmajor, devminor, rdevmajor, rdevminor, namesize := fields[7], fields[8], fields[9], fields[10], int64(fields[11])
+
+	if namesize == 0 || namesize > cpioMaxPath {
+		return fmt.Errorf("Bad cpio header: name size %d", namesize)
+	}
+	name := make([]byte, namesize)
+	if _, err := io.ReadFull(cr.r, name); err != nil {
+		return fmt.Errorf("Truncated cpio archive: %v", err)
+	}
+	if _, err := io.CopyN(ioutil.Discard, cr.r, cpioPad(cpioHeaderLen+namesize)); err != nil {
+		return fmt.Errorf("Truncated cpio archive: %v", err)
+	}
+	cr.stream = &io.LimitedReader{R: cr.r, N: size}
+	cr.pad = cpioPad(size)
+
+	hdr := &tar.Header{
+		Name:     strings.TrimRight(string(name), "\x00"),
+		Mode:     int64(mode & 07777),
+		Uid:      int(uid),
+		Gid:      int(gid),
+		ModTime:  time.Unix(int64(mtime), 0),
+		Devmajor: int64(rdevmajor),
+		Devminor: int64(rdevminor),
+	}
+	if hdr.Name == cpioTrailer {
+		cr.done = true
+		cr.flushPending()
+		return nil
+	}
+
+	switch mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		hdr.Typeflag = tar.TypeDir
+	case syscall.S_IFREG:
+		hdr.Typeflag = tar.TypeReg
+	case syscall.S_IFLNK:
+		if size > cpioMaxPath {
+			return fmt.Errorf("%s: symlink target too long", hdr.Name)
+		}
+		target, err := ioutil.ReadAll(cr.stream)
+		if err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = string(target)
+	case syscall.S_IFCHR:
+		hdr.Typeflag = tar.TypeChar
+	case syscall.S_IFBLK:
+		hdr.Typeflag = tar.TypeBlock
+	case syscall.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return fmt.Errorf("%s: unsupported cpio entry mode %o", hdr.Name, mode)
+	}
+
+	if hdr.Typeflag != tar.TypeReg || nlink < 2 {
+		cr.queue = append(cr.queue, cpioEntry{hdr: hdr, data: cr.stream})
+		return nil
+	}
+
+	id := cpioInode{dev: devmajor<<32 | devminor, ino: ino}
+	if target, ok := cr.linked[id]; ok && size == 0 {
+		hdr.Typeflag = tar.TypeLink
+		hdr.Linkname = target
+		cr.queue = append(cr.queue, cpioEntry{hdr: hdr, data: bytes.NewReader(nil)})
+		return nil
+	}
+	if size == 0 {
+		cr.pending[id] = append(cr.pending[id], hdr)
+		return nil
+	}
+	cr.queue = append(cr.queue, cpioEntry{hdr: hdr, data: cr.stream})
+	cr.linked[id] = hdr.Name
+	for _, link := range cr.pending[id] {
+		link.Typeflag = tar.TypeLink
+		link.Linkname = hdr.Name
+		cr.queue = append(cr.queue, cpioEntry{hdr: link, data: bytes.NewReader(nil)})
+	}
+	delete(cr.pending, id)
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+type testCpioEntry struct {
+	name  string
+	mode  uint32
+	ino   int
+	nlink int
+	data  string
+}
+
+func cpioPadding(n int) string {
+	return strings.Repeat("\x00", int(cpioPad(int64(n))))
+}
+
+// Write entries as a newc archive, followed by a trailer.
+func writeTestCpio(entries []testCpioEntry) []byte {
+	var buf bytes.Buffer
+	entries = append(entries, testCpioEntry{name: cpioTrailer, nlink: 1})
+	for _, e := range entries {
+		nlink := e.nlink
+		if nlink == 0 {
+			nlink = 1
+		}
+		fmt.Fprintf(&buf, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			cpioNewcMagic, e.ino, e.mode, 0, 0, nlink, 0, len(e.data), 0, 0, 0, 0, len(e.name)+1, 0)
+		buf.WriteString(e.name + "\x00" + cpioPadding(cpioHeaderLen+len(e.name)+1))
+		buf.WriteString(e.data + cpioPadding(len(e.data)))
+	}
+	return buf.Bytes()
+}
+
+func TestCpioReader(t *testing.T) {
+	type result struct {
+		name     string
+		typeflag byte
+		linkname string
+		data     string
+	}
+	reg := uint32(syscall.S_IFREG | 0644)
+	tests := []struct {
+		what    string
+		entries []testCpioEntry
+		want    []result
+	}{{
+		"padding",
+		[]testCpioEntry{
+			{name: "d", mode: syscall.S_IFDIR | 0755, ino: 1},
+			{name: "d/a", mode: reg, ino: 2, data: "x"},
+			{name: "d/bb", mode: reg, ino: 3, data: "xyzzy"},
+			{name: "d/ccc", mode: reg, ino: 4, data: "four"},
+			{name: "d/l", mode: syscall.S_IFLNK | 0777, ino: 5, data: "bb"},
+		},
+		[]result{
+			{"d", tar.TypeDir, "", ""},
+			{"d/a", tar.TypeReg, "", "x"},
+			{"d/bb", tar.TypeReg, "", "xyzzy"},
+			{"d/ccc", tar.TypeReg, "", "four"},
+			{"d/l", tar.TypeSymlink, "bb", ""},
+		},
+	}, {
+		"contents with the last name",
+		[]testCpioEntry{
+			{name: "a", mode: reg, ino: 7, nlink: 3},
+			{name: "other", mode: reg, ino: 8, data: "o"},
+			{name: "b", mode: reg, ino: 7, nlink: 3},
+			{name: "c", mode: reg, ino: 7, nlink: 3, data: "shared"},
+		},
+		[]result{
+			{"other", tar.TypeReg, "", "o"},
+			{"c", tar.TypeReg, "", "shared"},
+			{"a", tar.TypeLink, "c", ""},
+			{"b", tar.TypeLink, "c", ""},
+		},
+	}, {
+		"contents with the first name",
+		[]testCpioEntry{
+			{name: "a", mode: reg, ino: 7, nlink: 3, data: "shared"},
+			{name: "other", mode: reg, ino: 8, data: "o"},
+			{name: "b", mode: reg, ino: 7, nlink: 3},
+			{name: "c", mode: reg, ino: 7, nlink: 3},
+		},
+		[]result{
+			{"a", tar.TypeReg, "", "shared"},
+			{"other", tar.TypeReg, "", "o"},
+			{"b", tar.TypeLink, "a", ""},
+			{"c", tar.TypeLink, "a", ""},
+		},
+	}, {
+		"empty hard-linked files flushed at the trailer",
+		[]testCpioEntry{
+			{name: "a", mode: reg, ino: 9, nlink: 2},
+			{name: "b", mode: reg, ino: 9, nlink: 2},
+		},
+		[]result{
+			{"a", tar.TypeReg, "", ""},
+			{"b", tar.TypeLink, "a", ""},
+		},
+	}}
+
+	for _, test := range tests {
+		archive := writeTestCpio(test.entries)
+		// Anything after the trailer is ignored.
+		archive = append(archive, "garbage"...)
+		cr := newCpioReader(bytes.NewReader(archive))
+		got := []result{}
+		for {
+			hdr, err := cr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", test.what, err)
+			}
+			data, err := ioutil.ReadAll(cr)
+			if err != nil {
+				t.Fatalf("%s: %v", test.what, err)
+			}
+			got = append(got, result{hdr.Name, hdr.Typeflag, hdr.Linkname, string(data)})
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got %v, wanted %v", test.what, got, test.want)
+		}
+	}
+}
+
+// Entries whose contents are never read must still be skipped properly.
+func TestCpioReaderSkip(t *testing.T) {
+	archive := writeTestCpio([]testCpioEntry{
+		{name: "a", mode: syscall.S_IFREG | 0644, ino: 1, data: "skipped"},
+		{name: "b", mode: syscall.S_IFREG | 0644, ino: 2, data: "read"},
+	})
+	cr := newCpioReader(bytes.NewReader(archive))
+	names := []string{}
+	for {
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if strings.Join(names, ",") != "a,b" {
+		t.Errorf("got entries %v", names)
+	}
+}
+
+func TestCpioReaderBad(t *testing.T) {
+	good := writeTestCpio([]testCpioEntry{{name: "a", mode: syscall.S_IFREG | 0644, ino: 1, data: "x"}})
+	tests := map[string][]byte{
+		"bad magic": append([]byte("070707"), good[6:]...),
+		"truncated": good[:cpioHeaderLen+4],
+		// An 0xffffffff byte name would otherwise be allocated.
+		"huge name": append(append(append([]byte{}, good[:94]...), "ffffffff"...), good[102:]...),
+	}
+	for what, archive := range tests {
+		cr := newCpioReader(bytes.NewReader(archive))
+		var err error
+		for err == nil {
+			_, err = cr.Next()
+		}
+		if err == io.EOF {
+			t.Errorf("%s: read without error", what)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var sha256Digest = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// Resolve the source of an expand step, a path relative to the recipe
+// or a file:// URL, to a path.
+func expandSource(recipeDir, src string) (string, error) {
+	if !strings.Contains(src, "://") {
+		return recipePath(recipeDir, src), nil
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" || (u.Host != "" && u.Host != "localhost") {
+		return "", fmt.Errorf("Unsupported URL %s (only file:// URLs are supported)", src)
+	}
+	return u.Path, nil
+}
+
+// Check that the file f, opened from path, has the digest digest,
+// "sha256:<hex>", and rewind it so it can be read again.  Reading the
+// same open file twice means it can't be swapped for another between
+// the check and the read.
+func verifyDigest(f *os.File, path string, digest string) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	actual := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if actual != digest {
+		return fmt.Errorf("%s has digest %s, expected %s", path, actual, digest)
+	}
+	_, err := f.Seek(0, io.SeekStart)
+	return err
+}
+
+// Return r decompressed, going by its first bytes.  Uncompressed
+// streams are returned as they are.
+func decompress(r *bufio.Reader) (io.ReadCloser, error) {
+	magic, _ := r.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(r)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// Extract the tar or cpio archive at path, which may be compressed with
+// gzip, bzip2, xz or zstd, into rootfs.  If digest is set, the archive
+// must match it; it is checked before anything is extracted.
+func expandArchive(path string, digest string, rootfs string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if digest != "" {
+		if err := verifyDigest(f, path, digest); err != nil {
+			return err
+		}
+	}
+
+	dr, err := decompress(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("Failed decompressing %s: %v", path, err)
+	}
+	br := bufio.NewReader(dr)
+	var ar archiveReader = tar.NewReader(br)
+	if magic, _ := br.Peek(6); string(magic) == cpioNewcMagic || string(magic) == cpioNewcCrcMagic {
+		ar = newCpioReader(br)
+	}
+
+	opts := extractOptions{rootless: rootlessIDs}
+	err = extractArchive(ar, rootfs, opts)
+	if cerr := dr.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
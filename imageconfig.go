@@ -0,0 +1,340 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// The image config settings a target can make.  Anything left unset
+// (nil or empty) is inherited from the base image.
+type imageSettings struct {
+	entrypoint []string
+	cmd        []string
+	// KEY=value, in recipe order.
+	env     []string
+	labels  map[string]string
+	user    string
+	workdir string
+	volumes []string
+	// port/protocol, e.g. 80/tcp.
+	ports      []string
+	stopSignal string
+}
+
+// The recipe keywords which set image config, with their parsers.
+var imageConfigKeywords = map[string]func(s *imageSettings, file string, key *yaml.Node, n *yaml.Node) error{
+	"entrypoint": func(s *imageSettings, file string, key *yaml.Node, n *yaml.Node) (err error) {
+		s.entrypoint, err = parseCommand(file, key, n, s.entrypoint)
+		return err
+	},
+	"cmd": func(s *imageSettings, file string, key *yaml.Node, n *yaml.Node) (err error) {
+		s.cmd, err = parseCommand(file, key, n, s.cmd)
+		return err
+	},
+	"env":        (*imageSettings).setEnv,
+	"labels":     (*imageSettings).setLabels,
+	"user":       (*imageSettings).setUser,
+	"workdir":    (*imageSettings).setWorkdir,
+	"volumes":    (*imageSettings).setVolumes,
+	"ports":      (*imageSettings).setPorts,
+	"stopsignal": (*imageSettings).setStopSignal,
+}
+
+var (
+	envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	portPattern   = regexp.MustCompile(`^([0-9]+)(/(tcp|udp|sctp))?$`)
+	userPattern   = regexp.MustCompile(`^[^:]+(:[^:]+)?$`)
+)
+
+func duplicateKeyword(file string, key *yaml.Node) error {
+	return nodePos(file, key).Errorf("Duplicate %s", key.Value)
+}
+
+// Parse an entrypoint or cmd: either a string, which is run by the
+// shell, or a list of strings, which is run as it is.  prev is the
+// value already set, as each may only be given once.
+func parseCommand(file string, key *yaml.Node, n *yaml.Node, prev []string) ([]string, error) {
+	if prev != nil {
+		return nil, duplicateKeyword(file, key)
+	}
+	if n.Kind == yaml.SequenceNode {
+		return scalarList(file, n, key.Value)
+	}
+	cmd, err := scalarValue(file, n, key.Value)
+	if err != nil {
+		return nil, err
+	}
+	return []string{"/bin/sh", "-c", cmd}, nil
+}
+
+// Call fn for each string in n, which is a string or a list of them,
+// with the string's position.
+func forEachScalar(file string, n *yaml.Node, what string, fn func(v string, pos recipePos) error) error {
+	nodes := []*yaml.Node{n}
+	if n.Kind == yaml.SequenceNode {
+		nodes = n.Content
+	}
+	for _, e := range nodes {
+		v, err := scalarValue(file, e, what)
+		if err != nil {
+			return err
+		}
+		if err := fn(v, nodePos(file, e)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the strings in n, which is a string or a list of them.
+func scalarList(file string, n *yaml.Node, what string) ([]string, error) {
+	values := []string{}
+	err := forEachScalar(file, n, what, func(v string, pos recipePos) error {
+		values = append(values, v)
+		return nil
+	})
+	return values, err
+}
+
+// Call fn for each key and value of the map of strings n, in order.
+func forEachPair(file string, n *yaml.Node, what string, fn func(k, v string, pos recipePos) error) error {
+	if n.Kind != yaml.MappingNode {
+		return nodePos(file, n).Errorf("Parse error reading %s: expected a map", what)
+	}
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, err := scalarValue(file, n.Content[i], what)
+		if err != nil {
+			return err
+		}
+		v, err := scalarValue(file, n.Content[i+1], what)
+		if err != nil {
+			return err
+		}
+		if seen[k] {
+			return nodePos(file, n.Content[i]).Errorf("Duplicate %s %s", what, k)
+		}
+		seen[k] = true
+		if err := fn(k, v, nodePos(file, n.Content[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// env is a map of names to values, or a list of NAME=value strings.
+func (s *imageSettings) setEnv(file string, key *yaml.Node, n *yaml.Node) error {
+	if s.env != nil {
+		return duplicateKeyword(file, key)
+	}
+	s.env = []string{}
+	if n.Kind == yaml.MappingNode {
+		return forEachPair(file, n, "env", func(k, v string, pos recipePos) error {
+			if !envKeyPattern.MatchString(k) {
+				return pos.Errorf("Bad environment variable name %s", k)
+			}
+			s.env = append(s.env, k+"="+v)
+			return nil
+		})
+	}
+	return forEachScalar(file, n, "env", func(v string, pos recipePos) error {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || !envKeyPattern.MatchString(kv[0]) {
+			return pos.Errorf("Bad environment variable %s: expected NAME=value", v)
+		}
+		s.env = append(s.env, v)
+		return nil
+	})
+}
+
+func (s *imageSettings) setLabels(file string, key *yaml.Node, n *yaml.Node) error {
+	if s.labels != nil {
+		return duplicateKeyword(file, key)
+	}
+	s.labels = map[string]string{}
+	return forEachPair(file, n, "label", func(k, v string, pos recipePos) error {
+		s.labels[k] = v
+		return nil
+	})
+}
+
+// user is a user name or uid, optionally followed by :group or :gid.
+func (s *imageSettings) setUser(file string, key *yaml.Node, n *yaml.Node) error {
+	if s.user != "" {
+		return duplicateKeyword(file, key)
+	}
+	user, err := scalarValue(file, n, "user")
+	if err != nil {
+		return err
+	}
+	if !userPattern.MatchString(user) {
+		return nodePos(file, n).Errorf("Bad user %s: expected user[:group]", user)
+	}
+	s.user = user
+	return nil
+}
+
+func (s *imageSettings) setWorkdir(file string, key *yaml.Node, n *yaml.Node) error {
+	if s.workdir != "" {
+		return duplicateKeyword(file, key)
+	}
+	dir, err := scalarValue(file, n, "workdir")
+	if err != nil {
+		return err
+	}
+	if !path.IsAbs(dir) {
+		return nodePos(file, n).Errorf("Bad workdir %s: must be an absolute path", dir)
+	}
+	s.workdir = path.Clean(dir)
+	return nil
+}
+
+func (s *imageSettings) setVolumes(file string, key *yaml.Node, n *yaml.Node) error {
+	if s.volumes != nil {
+		return duplicateKeyword(file, key)
+	}
+	s.volumes = []string{}
+	return forEachScalar(file, n, "volume", func(v string, pos recipePos) error {
+		if !path.IsAbs(v) {
+			return pos.Errorf("Bad volume %s: must be an absolute path", v)
+		}
+		s.volumes = append(s.volumes, path.Clean(v))
+		return nil
+	})
+}
+
+// ports are port numbers, optionally followed by /tcp, /udp or /sctp.
+// tcp is assumed if no protocol is given.
+func (s *imageSettings) setPorts(file string, key *yaml.Node, n *yaml.Node) error {
+	if s.ports != nil {
+		return duplicateKeyword(file, key)
+	}
+	s.ports = []string{}
+	return forEachScalar(file, n, "port", func(p string, pos recipePos) error {
+		m := portPattern.FindStringSubmatch(p)
+		if m == nil {
+			return pos.Errorf("Bad port %s: expected port[/tcp|/udp|/sctp]", p)
+		}
+		num, err := strconv.Atoi(m[1])
+		if err != nil || num < 1 || num > 65535 {
+			return pos.Errorf("Bad port %s: out of range", p)
+		}
+		proto := m[3]
+		if proto == "" {
+			proto = "tcp"
+		}
+		s.ports = append(s.ports, strconv.Itoa(num)+"/"+proto)
+		return nil
+	})
+}
+
+// stopsignal is a signal name, with or without SIG, or number.
+func (s *imageSettings) setStopSignal(file string, key *yaml.Node, n *yaml.Node) error {
+	if s.stopSignal != "" {
+		return duplicateKeyword(file, key)
+	}
+	sig, err := scalarValue(file, n, "stopsignal")
+	if err != nil {
+		return err
+	}
+	if num, err := strconv.Atoi(sig); err == nil {
+		if num < 1 || num > 64 {
+			return nodePos(file, n).Errorf("Bad stopsignal %s: out of range", sig)
+		}
+		s.stopSignal = sig
+		return nil
+	}
+	name := strings.ToUpper(sig)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if unix.SignalNum(name) == 0 {
+		return nodePos(file, n).Errorf("Bad stopsignal %s: unknown signal", sig)
+	}
+	s.stopSignal = name
+	return nil
+}
+
+// Whether the target sets anything in the image config.
+func (s *imageSettings) hasConfig() bool {
+	return s.entrypoint != nil || s.cmd != nil || s.env != nil || s.labels != nil ||
+		s.user != "" || s.workdir != "" || s.volumes != nil || s.ports != nil || s.stopSignal != ""
+}
+
+// Apply the target's settings to config, which starts out as its base
+// image's.  Environment variables, labels, volumes and ports are merged
+// with the base image's; everything else the target sets replaces the
+// base image's.  As with docker, setting an entrypoint but no cmd drops
+// the base image's cmd, which was meant for the base's entrypoint.
+func (s *imageSettings) applyConfig(config *ispec.ImageConfig) error {
+	if s.entrypoint != nil {
+		config.Entrypoint = s.entrypoint
+		if s.cmd == nil {
+			config.Cmd = nil
+		}
+	}
+	if s.cmd != nil {
+		config.Cmd = s.cmd
+	}
+	for _, kv := range s.env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		replaced := false
+		for i, old := range config.Env {
+			if strings.SplitN(old, "=", 2)[0] == name {
+				config.Env[i] = kv
+				replaced = true
+			}
+		}
+		if !replaced {
+			config.Env = append(config.Env, kv)
+		}
+	}
+	if len(s.labels) > 0 && config.Labels == nil {
+		config.Labels = map[string]string{}
+	}
+	for k, v := range s.labels {
+		config.Labels[k] = v
+	}
+	if s.user != "" {
+		config.User = s.user
+	}
+	if s.workdir != "" {
+		config.WorkingDir = s.workdir
+	}
+	if len(s.volumes) > 0 && config.Volumes == nil {
+		config.Volumes = map[string]struct{}{}
+	}
+	for _, v := range s.volumes {
+		config.Volumes[v] = struct{}{}
+	}
+	if len(s.ports) > 0 && config.ExposedPorts == nil {
+		config.ExposedPorts = map[string]struct{}{}
+	}
+	for _, p := range s.ports {
+		config.ExposedPorts[p] = struct{}{}
+	}
+	if s.stopSignal != "" {
+		config.StopSignal = s.stopSignal
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Parse a recipe with a single target whose settings after its base are
+// body, and return the target.
+func parseTestTarget(body string) (*buildTarget, error) {
+	r, err := parseRecipe("r.yaml", []byte("a:\n  base: empty\n"+body))
+	if err != nil {
+		return nil, err
+	}
+	return &r.Targets[0], nil
+}
+
+func TestImageConfigErrors(t *testing.T) {
+	tests := []struct {
+		what string
+		body string
+		err  string
+	}{
+		{"env entry", "  env:\n    - A=1\n    - nope\n", "r.yaml:5:7: Bad environment variable nope"},
+		{"env name", "  env: [A=1, 1B=2]\n", "r.yaml:3:14: Bad environment variable 1B=2"},
+		{"env map name", "  env:\n    A: 1\n    B-C: 2\n", "r.yaml:5:5: Bad environment variable name B-C"},
+		{"env map duplicate", "  env:\n    A: 1\n    A: 2\n", "r.yaml:5:5: Duplicate env A"},
+		{"env nested", "  env:\n    - [A=1]\n", "r.yaml:4:7: Parse error reading env"},
+		{"duplicate env", "  env: [A=1]\n  env: [B=2]\n", "r.yaml:4:3: Duplicate env"},
+		{"volume", "  volumes:\n    - /data\n    - data\n", "r.yaml:5:7: Bad volume data"},
+		{"port", "  ports:\n    - 80\n    - 443/tcp\n    - 53/dns\n", "r.yaml:6:7: Bad port 53/dns"},
+		{"port range", "  ports: [80, 70000]\n", "r.yaml:3:15: Bad port 70000: out of range"},
+		{"port zero", "  ports: 0\n", "r.yaml:3:10: Bad port 0: out of range"},
+		{"user", "  user: a:b:c\n", "r.yaml:3:9: Bad user a:b:c"},
+		{"workdir", "  workdir: srv\n", "r.yaml:3:12: Bad workdir srv"},
+		{"stopsignal", "  stopsignal: SIGNOPE\n", "r.yaml:3:15: Bad stopsignal SIGNOPE: unknown signal"},
+		{"stopsignal range", "  stopsignal: 99\n", "r.yaml:3:15: Bad stopsignal 99: out of range"},
+		{"labels list", "  labels: [a]\n", "r.yaml:3:11: Parse error reading label: expected a map"},
+		{"entrypoint map", "  entrypoint: {a: b}\n", "r.yaml:3:15: Parse error reading entrypoint"},
+		{"duplicate cmd", "  cmd: ls\n  cmd: [ls]\n", "r.yaml:4:3: Duplicate cmd"},
+	}
+	for _, test := range tests {
+		_, err := parseTestTarget(test.body)
+		checkError(t, test.what, err, test.err)
+	}
+}
+
+func TestImageConfigSettings(t *testing.T) {
+	tests := []struct {
+		body    string
+		setting string
+		want    string
+	}{
+		{"  entrypoint: echo hi\n", "entrypoint", "[/bin/sh -c echo hi]"},
+		{"  entrypoint: [echo, hi]\n", "entrypoint", "[echo hi]"},
+		{"  entrypoint: [echo hi]\n", "entrypoint", "[echo hi]"},
+		{"  cmd: ls -l\n", "cmd", "[/bin/sh -c ls -l]"},
+		{"  cmd: [ls, -l]\n", "cmd", "[ls -l]"},
+		{"  cmd: []\n", "cmd", "[]"},
+		{"  env: [A=1, B=x=y]\n", "env", "[A=1 B=x=y]"},
+		{"  env:\n    B: 2\n    A: 1\n", "env", "[B=2 A=1]"},
+		{"  volumes: /data/../srv/\n", "volumes", "[/srv]"},
+		{"  ports: [80, 53/udp]\n", "ports", "[80/tcp 53/udp]"},
+		{"  stopsignal: term\n", "stopsignal", "SIGTERM"},
+		{"  stopsignal: 9\n", "stopsignal", "9"},
+		{"  workdir: /srv/\n", "workdir", "/srv"},
+		{"  user: www-data:adm\n", "user", "www-data:adm"},
+	}
+	for _, test := range tests {
+		bt, err := parseTestTarget(test.body)
+		if err != nil {
+			t.Errorf("%q: %v", test.body, err)
+			continue
+		}
+		s := bt.imageSettings
+		got := map[string]string{
+			"entrypoint": fmt.Sprint(s.entrypoint),
+			"cmd":        fmt.Sprint(s.cmd),
+			"env":        fmt.Sprint(s.env),
+			"volumes":    fmt.Sprint(s.volumes),
+			"ports":      fmt.Sprint(s.ports),
+			"stopsignal": s.stopSignal,
+			"workdir":    s.workdir,
+			"user":       s.user,
+		}
+		if got[test.setting] != test.want {
+			t.Errorf("%q: got %s %s, wanted %s", test.body, test.setting, got[test.setting], test.want)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	base := func() ispec.ImageConfig {
+		return ispec.ImageConfig{
+			Entrypoint: []string{"/init"},
+			Cmd:        []string{"--serve"},
+			Env:        []string{"PATH=/bin", "A=1"},
+			Labels:     map[string]string{"a": "1"},
+		}
+	}
+	tests := []struct {
+		what     string
+		settings imageSettings
+		want     string
+	}{
+		{"nothing", imageSettings{}, "[/init] [--serve] [PATH=/bin A=1] map[a:1]"},
+		{"entrypoint drops cmd", imageSettings{entrypoint: []string{"/app"}}, "[/app] [] [PATH=/bin A=1] map[a:1]"},
+		{"entrypoint and cmd", imageSettings{entrypoint: []string{"/app"}, cmd: []string{"-v"}}, "[/app] [-v] [PATH=/bin A=1] map[a:1]"},
+		{"cmd keeps entrypoint", imageSettings{cmd: []string{"-v"}}, "[/init] [-v] [PATH=/bin A=1] map[a:1]"},
+		{"env merged", imageSettings{env: []string{"A=2", "B=3"}}, "[/init] [--serve] [PATH=/bin A=2 B=3] map[a:1]"},
+		{"labels merged", imageSettings{labels: map[string]string{"b": "2"}}, "[/init] [--serve] [PATH=/bin A=1] map[a:1 b:2]"},
+	}
+	for _, test := range tests {
+		config := base()
+		if err := test.settings.applyConfig(&config); err != nil {
+			t.Errorf("%s: %v", test.what, err)
+			continue
+		}
+		got := fmt.Sprint(config.Entrypoint, config.Cmd, config.Env, config.Labels)
+		if got != test.want {
+			t.Errorf("%s: got %s, wanted %s", test.what, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Where and how an install step puts its files.  Empty fields mean the
+// defaults: into /, keeping the files' own modes and ownership.
+type installOptions struct {
+	dest  string
+	mode  string
+	owner string
+	group string
+}
+
+// Return the files an install step's src glob names, relative to the
+// recipe.
+func installSources(recipeDir, src string) ([]string, error) {
+	matches, err := filepath.Glob(recipePath(recipeDir, src))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s matches nothing", src)
+	}
+	return matches, nil
+}
+
+// Look up name, a user or group name or a numeric id, in the rootfs's
+// passwd or group file.
+func lookupID(rootfs string, file string, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	fields, err := lookupEntry(rootfs, file, 0, name)
+	if err != nil {
+		return 0, fmt.Errorf("Can't look up %s: %v", name, err)
+	}
+	if fields == nil {
+		return 0, fmt.Errorf("No %s in the image's %s", name, file)
+	}
+	return strconv.Atoi(fields[2])
+}
+
+// Return the fields of the first entry in the rootfs's passwd or group
+// file whose field'th field is value, or nil if there is none.  The file
+// is found as it would be inside the rootfs.
+func lookupEntry(rootfs string, file string, field int, value string) ([]string, error) {
+	path, err := resolvePath(rootfs, file, true)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) > 3 && fields[field] == value {
+			return fields, nil
+		}
+	}
+	return nil, scanner.Err()
+}
+
+// Resolve an image config's user, "user[:group]" with either given by
+// name or id, against the rootfs.  Without a group, the user's primary
+// group in passwd is used, or 0 if passwd doesn't list the user.
+func lookupUser(rootfs string, user string) (int, int, error) {
+	ids := strings.SplitN(user, ":", 2)
+	uid, err := lookupID(rootfs, "etc/passwd", ids[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(ids) > 1 {
+		gid, err := lookupID(rootfs, "etc/group", ids[1])
+		return uid, gid, err
+	}
+	fields, err := lookupEntry(rootfs, "etc/passwd", 2, strconv.Itoa(uid))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, fmt.Errorf("Can't look up %s: %v", user, err)
+	}
+	if fields == nil {
+		return uid, 0, nil
+	}
+	gid, err := strconv.Atoi(fields[3])
+	return uid, gid, err
+}
+
+// How to set the metadata of installed files, resolved against the
+// rootfs.  A negative id means keep the source file's.
+type installAttrs struct {
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+func (o installOptions) resolve(rootfs string) (installAttrs, error) {
+	attrs := installAttrs{uid: -1, gid: -1}
+	var err error
+	if o.mode != "" {
+		m, _ := strconv.ParseUint(o.mode, 8, 32)
+		attrs.mode = os.FileMode(m&0777) | modeBits(uint32(m))
+	}
+	if o.owner != "" {
+		if attrs.uid, err = lookupID(rootfs, "etc/passwd", o.owner); err != nil {
+			return attrs, err
+		}
+	}
+	if o.group != "" {
+		if attrs.gid, err = lookupID(rootfs, "etc/group", o.group); err != nil {
+			return attrs, err
+		}
+	}
+	return attrs, nil
+}
+
+// Copy the file, symlink or directory tree src to dest, a path in the
+// rootfs.  Whatever is at dest is replaced, unless both are directories.
+// Every path written is resolved as it would be inside the rootfs (see
+// resolvePath), so symlinks in the rootfs can't redirect the copy
+// outside it, while absolute ones such as /var/run -> /run still work.
+func copyTree(src string, rootfs string, destRel string, attrs installAttrs) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	dest, err := resolvePath(rootfs, destRel, true)
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	mode := fi.Mode()
+
+	switch {
+	case mode.IsDir():
+		if err := os.Mkdir(dest, mode.Perm()); err != nil && !os.IsExist(err) {
+			return err
+		}
+		entries, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := copyTree(filepath.Join(src, e.Name()), rootfs, filepath.Join(destRel, e.Name()), attrs); err != nil {
+				return err
+			}
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dest); err != nil {
+			return err
+		}
+	case mode.IsRegular():
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode.Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Can't install %s: not a file, directory or symlink", src)
+	}
+
+	uid, gid := int(st.Uid), int(st.Gid)
+	if attrs.uid >= 0 {
+		uid = attrs.uid
+	}
+	if attrs.gid >= 0 {
+		gid = attrs.gid
+	}
+	if !rootlessIDs {
+		if err := os.Lchown(dest, uid, gid); err != nil {
+			return err
+		}
+	}
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	// chown clears setuid bits, so set the mode afterwards.  Directories
+	// keep their own modes, as a file mode would make them unusable.
+	perm := mode.Perm() | modeBits(uint32(st.Mode))
+	if attrs.mode != 0 && mode.IsRegular() {
+		perm = attrs.mode
+	}
+	return os.Chmod(dest, perm)
+}
+
+// Copy the files matching src into the rootfs per opts.  With a single
+// source and a dest not ending in /, dest is the installed file's path;
+// otherwise sources are copied into the directory dest, which is
+// created if needed.
+func installFiles(recipeDir, src string, opts installOptions, rootfs string) error {
+	sources, err := installSources(recipeDir, src)
+	if err != nil {
+		return err
+	}
+	attrs, err := opts.resolve(rootfs)
+	if err != nil {
+		return err
+	}
+
+	dest := opts.dest
+	if dest == "" {
+		dest = "/"
+	}
+	// Resolve a path inside dest, so that if dest is a symlink to a
+	// directory we find out where it points.
+	inside, err := resolvePath(rootfs, filepath.Join(dest, "x"), true)
+	if err != nil {
+		return err
+	}
+	destDir := filepath.Dir(inside)
+	fi, err := os.Stat(destDir)
+	intoDir := len(sources) > 1 || strings.HasSuffix(dest, "/") || (err == nil && fi.IsDir())
+	if intoDir {
+		err = os.MkdirAll(destDir, 0755)
+	} else {
+		err = os.MkdirAll(filepath.Dir(destDir), 0755)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sources {
+		target := dest
+		if intoDir {
+			target = filepath.Join(dest, filepath.Base(s))
+		}
+		if err := copyTree(s, rootfs, target, attrs); err != nil {
+			return fmt.Errorf("Failed installing %s: %v", s, err)
+		}
+	}
+	return nil
+}
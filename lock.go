@@ -0,0 +1,139 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// An exclusive flock on a lock file.  The holder writes its PID into
+// the file, so that anyone waiting can say who they are waiting for.
+// The kernel drops the lock when the holder exits, however it exits.
+type fileLock struct {
+	f  *os.File
+	mu *sync.Mutex
+}
+
+// flock only excludes other processes reliably; goroutines of this
+// process (parallel builds) queue on a mutex per lock file instead, so
+// they wait for each other however long it takes.
+var (
+	processLocksMutex sync.Mutex
+	processLocks      = map[string]*sync.Mutex{}
+)
+
+func processLock(path string) *sync.Mutex {
+	processLocksMutex.Lock()
+	defer processLocksMutex.Unlock()
+	mu, ok := processLocks[path]
+	if !ok {
+		mu = &sync.Mutex{}
+		processLocks[path] = mu
+	}
+	return mu
+}
+
+const lockPollInterval = 100 * time.Millisecond
+
+// Take the lock at path, waiting up to timeout for whoever holds it.
+// what names the locked thing in errors.
+func takeLock(path string, what string, timeout time.Duration) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	mu := processLock(path)
+	mu.Lock()
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		mu.Unlock()
+		return nil, fmt.Errorf("Failed opening lock %s: %v", path, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			f.Close()
+			mu.Unlock()
+			return nil, fmt.Errorf("Failed locking %s: %v", what, err)
+		}
+		holder := lockHolder(path)
+		if time.Now().After(deadline) {
+			f.Close()
+			mu.Unlock()
+			return nil, fmt.Errorf("%s is locked by process %s (gave up after %v)", what, holder, timeout)
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "Waiting for process %s to release %s\n", holder, what)
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	}
+	return &fileLock{f: f, mu: mu}, nil
+}
+
+func lockHolder(path string) string {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "(unknown)"
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return "(unknown)"
+	}
+	return strconv.Itoa(pid)
+}
+
+func (l *fileLock) Unlock() {
+	l.f.Truncate(0)
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+	l.mu.Unlock()
+}
+
+func (c *stackerConfig) lockTimeout() time.Duration {
+	d, err := time.ParseDuration(c.LockTimeout)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// Lock BaseDir, i.e. the checkout and the driver's storage.
+func (c *stackerConfig) LockBaseDir() (*fileLock, error) {
+	return takeLock(filepath.Join(c.stateDir(), "lock"), c.BaseDir, c.lockTimeout())
+}
+
+// Lock the OCI layout while its index is updated.  The lock file lives
+// next to the layout rather than in it, as the layout may not exist yet.
+func (c *stackerConfig) LockOciDir() (*fileLock, error) {
+	return takeLock(filepath.Clean(c.OciDir)+".lock", c.OciDir, c.lockTimeout())
+}
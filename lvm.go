@@ -0,0 +1,383 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// The lvm driver keeps every OCI layer in a thin LV named
+// layer-<chain id> in the configured thin pool.  Each layer's LV is a thin
+// snapshot of its parent layer's LV with the layer applied on top.  A
+// layer is unpacked under a tmp- name and only renamed once complete, so
+// an interrupted unpack is never mistaken for a finished layer.  A
+// checkout is a thin snapshot of the top layer's LV, mounted as the
+// rootfs of the unpack dir.
+type lvmStorage struct {
+	c *stackerConfig
+}
+
+func init() {
+	registerStorage("lvm", func(c *stackerConfig) Storage { return &lvmStorage{c} })
+}
+
+func lvmCheckoutLV(c *stackerConfig) string {
+	return "checkout" + c.checkoutSuffix()
+}
+
+func lvmLayerLV(chainID string) string {
+	return "layer-" + chainID
+}
+
+func lvmDevice(c *stackerConfig, lv string) string {
+	return fmt.Sprintf("/dev/%s/%s", c.LvmVG, lv)
+}
+
+func lvmLVExists(c *stackerConfig, lv string) bool {
+	_, err := runCaptured("lvs", "--noheadings", c.LvmVG+"/"+lv)
+	return err == nil
+}
+
+func lvmRemoveLV(c *stackerConfig, lv string) error {
+	_, err := runCaptured("lvremove", "-f", c.LvmVG+"/"+lv)
+	return err
+}
+
+// Create an LV named lv: a thin snapshot of parent, or a freshly
+// formatted thin LV if parent is "".
+func lvmCreateLV(c *stackerConfig, parent, lv string) error {
+	if parent != "" {
+		_, err := runCaptured("lvcreate", "-s", "-kn", "-n", lv, c.LvmVG+"/"+parent)
+		return err
+	}
+	_, err := runCaptured("lvcreate", "-V", c.LvmLVSize, "-T", c.LvmVG+"/"+c.LvmThinPool, "-n", lv)
+	if err != nil {
+		return err
+	}
+	if _, err := runCaptured("mkfs.ext4", "-q", lvmDevice(c, lv)); err != nil {
+		lvmRemoveLV(c, lv)
+		return err
+	}
+	return nil
+}
+
+func lvmApplyLayer(ctx context.Context, engine casext.Engine, c *stackerConfig, l ispec.Descriptor, lv string) error {
+	mnt, err := ioutil.TempDir("", "stacker_lvm_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mnt)
+	if err := syscall.Mount(lvmDevice(c, lv), mnt, "ext4", 0, ""); err != nil {
+		return err
+	}
+	err = applyLayer(ctx, engine, l, mnt)
+	if uerr := syscall.Unmount(mnt, 0); uerr != nil && err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// Make sure every layer of manifest has an LV, and return the name of
+// the top layer's LV, or "" if the image has no layers.
+func lvmUnpackLayers(ctx context.Context, engine casext.Engine, c *stackerConfig, manifest ispec.Manifest) (string, error) {
+	prev := ""
+	chainIDs := layerChainIDs(manifest)
+	for i, l := range manifest.Layers {
+		lv := lvmLayerLV(chainIDs[i])
+		if lvmLVExists(c, lv) {
+			prev = lv
+			continue
+		}
+
+		tmp := "tmp-" + chainIDs[i]
+		if lvmLVExists(c, tmp) {
+			if err := lvmRemoveLV(c, tmp); err != nil {
+				return "", err
+			}
+		}
+		if err := lvmCreateLV(c, prev, tmp); err != nil {
+			return "", err
+		}
+		if err := lvmApplyLayer(ctx, engine, c, l, tmp); err != nil {
+			lvmRemoveLV(c, tmp)
+			return "", fmt.Errorf("Failed unpacking layer %s: %v", l.Digest, err)
+		}
+		if _, err := runCaptured("lvrename", c.LvmVG, tmp, lv); err != nil {
+			lvmRemoveLV(c, tmp)
+			return "", err
+		}
+		prev = lv
+	}
+	return prev, nil
+}
+
+func (s *lvmStorage) Unpack() error {
+	return forEachTagManifest(s.c, func(ctx context.Context, engine casext.Engine, manifest ispec.Manifest) error {
+		_, err := lvmUnpackLayers(ctx, engine, s.c, manifest)
+		return err
+	})
+}
+
+func (s *lvmStorage) Checkout(tag string) error {
+	engine, err := openOCI(s.c.OciDir)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+	ctx := context.Background()
+
+	desc, manifest, err := tagManifest(ctx, engine, tag)
+	if err != nil {
+		return err
+	}
+	top, err := lvmUnpackLayers(ctx, engine, s.c, manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := lvmCreateLV(s.c, top, lvmCheckoutLV(s.c)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.c.RootfsDir(), 0755); err != nil {
+		s.Abort()
+		return err
+	}
+	if err := syscall.Mount(lvmDevice(s.c, lvmCheckoutLV(s.c)), s.c.RootfsDir(), "ext4", 0, ""); err != nil {
+		s.Abort()
+		return err
+	}
+
+	if err := finishBundle(ctx, engine, s.c.UnpackDir(), desc, manifest); err != nil {
+		s.Abort()
+		return err
+	}
+	if err := writeBundleMtree(s.c.UnpackDir()); err != nil {
+		s.Abort()
+		return err
+	}
+	return nil
+}
+
+func (s *lvmStorage) Checkin(tag string, from ispec.Descriptor, update *imageUpdate) error {
+	if err := RepackBundle(s.c.OciDir, tag, s.c.UnpackDir(), from, update); err != nil {
+		return err
+	}
+	return s.Abort()
+}
+
+// Unmount and remove the checkout LV, and remove the unpack dir.
+func (s *lvmStorage) Abort() error {
+	if IsMountpoint(s.c.RootfsDir()) {
+		if err := syscall.Unmount(s.c.RootfsDir(), 0); err != nil {
+			return err
+		}
+	}
+	if lvmLVExists(s.c, lvmCheckoutLV(s.c)) {
+		if err := lvmRemoveLV(s.c, lvmCheckoutLV(s.c)); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(s.c.UnpackDir())
+}
+
+// Return the loop devices lofile is attached to.
+func loopDevices(lofile string) ([]string, error) {
+	out, err := runCaptured("losetup", "-j", lofile)
+	if err != nil {
+		return nil, err
+	}
+	devs := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		if i := strings.Index(line, ":"); i > 0 {
+			devs = append(devs, line[:i])
+		}
+	}
+	return devs, nil
+}
+
+// Create a VG with a thin pool on a loop device backed by lofile if
+// needed, and make sure it is attached and active.  What is missing is
+// worked out from what LVM reports rather than from whether lofile
+// existed, so a setup that failed partway through is finished off.
+func (s *lvmStorage) Setup() error {
+	if s.c.LoFile == "" {
+		return fmt.Errorf("No loopback file configured for lvm")
+	}
+	if !FileExists(s.c.LoFile) {
+		if _, err := runCaptured("truncate", "-s", "20G", s.c.LoFile); err != nil {
+			return err
+		}
+	}
+
+	devs, err := loopDevices(s.c.LoFile)
+	if err != nil {
+		return err
+	}
+	dev := ""
+	if len(devs) > 0 {
+		dev = devs[0]
+	} else {
+		dev, err = runCaptured("losetup", "--find", "--show", s.c.LoFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := runCaptured("pvs", dev); err != nil {
+		if _, err := runCaptured("pvcreate", dev); err != nil {
+			return err
+		}
+	}
+	if _, err := runCaptured("vgs", s.c.LvmVG); err != nil {
+		if _, err := runCaptured("vgcreate", s.c.LvmVG, dev); err != nil {
+			return err
+		}
+	}
+	if !lvmLVExists(s.c, s.c.LvmThinPool) {
+		if _, err := runCaptured("lvcreate", "-l", "95%FREE", "-T", s.c.LvmVG+"/"+s.c.LvmThinPool); err != nil {
+			return err
+		}
+	}
+	_, err = runCaptured("vgchange", "-ay", s.c.LvmVG)
+	return err
+}
+
+// Return the PVs making up vg.
+func lvmVGPVs(vg string) ([]string, error) {
+	out, err := runCaptured("vgs", "--noheadings", "-o", "pv_name", vg)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// Remove the VG, and detach and remove its loopback file.  Only a VG
+// whose sole PV is our loop device is removed; any other VG of the same
+// name belongs to someone else.
+func (s *lvmStorage) Teardown() error {
+	if s.c.LoFile == "" {
+		return fmt.Errorf("No loopback file configured for lvm")
+	}
+	if _, err := runCaptured("vgs", s.c.LvmVG); err == nil {
+		pvs, err := lvmVGPVs(s.c.LvmVG)
+		if err != nil {
+			return err
+		}
+		devs := []string{}
+		if FileExists(s.c.LoFile) {
+			if devs, err = loopDevices(s.c.LoFile); err != nil {
+				return err
+			}
+		}
+		owned := false
+		for _, dev := range devs {
+			owned = owned || (len(pvs) == 1 && pvs[0] == dev)
+		}
+		if !owned {
+			return fmt.Errorf("Refusing to remove VG %s: its only PV is not a loop device for %s", s.c.LvmVG, s.c.LoFile)
+		}
+		if _, err := runCaptured("vgremove", "-f", s.c.LvmVG); err != nil {
+			return err
+		}
+	}
+	if FileExists(s.c.LoFile) {
+		devs, err := loopDevices(s.c.LoFile)
+		if err != nil {
+			return err
+		}
+		for _, dev := range devs {
+			if _, err := runCaptured("losetup", "-d", dev); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(s.c.LoFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *lvmStorage) RootfsPath() string {
+	return s.c.BaseDir + "/unpacked" + s.c.checkoutSuffix() + "/rootfs"
+}
+
+func (s *lvmStorage) Describe(w io.Writer) {
+	fmt.Fprintf(w, "  thin pool: %s/%s\n", s.c.LvmVG, s.c.LvmThinPool)
+	if s.c.LoFile != "" {
+		fmt.Fprintf(w, "  loopback file: %s\n", s.c.LoFile)
+	}
+}
+
+func (s *lvmStorage) Health() storageHealth {
+	h := storageHealth{
+		LoFile:       s.c.LoFile,
+		LoFileExists: s.c.LoFile != "" && FileExists(s.c.LoFile),
+	}
+	if h.LoFileExists {
+		devs, err := loopDevices(s.c.LoFile)
+		h.Mounted = err == nil && len(devs) > 0
+	}
+	out, err := runCaptured("lvs", "--noheadings", "--units", "b", "--nosuffix",
+		"-o", "lv_size,data_percent", s.c.LvmVG+"/"+s.c.LvmThinPool)
+	if err != nil {
+		return h
+	}
+	vals := strings.Fields(out)
+	if len(vals) == 2 {
+		size, _ := strconv.ParseUint(vals[0], 10, 64)
+		percent, _ := strconv.ParseFloat(vals[1], 64)
+		h.Size = size
+		h.Used = uint64(float64(size) * percent / 100)
+	}
+	return h
+}
+
+func (s *lvmStorage) Dirty() (bool, error) {
+	diffs, err := bundleDiffs(s.c.UnpackDir())
+	return len(diffs) > 0, err
+}
+
+// Remove layer LVs no tag uses, and any left over from an interrupted
+// unpack.  Thin snapshots don't depend on their origin, so they can go
+// in any order.
+func (s *lvmStorage) GC() error {
+	layers, err := referencedChains(s.c)
+	if err != nil {
+		return err
+	}
+	out, err := runCaptured("lvs", "--noheadings", "-o", "lv_name", s.c.LvmVG)
+	if err != nil {
+		return err
+	}
+	for _, lv := range strings.Fields(out) {
+		if strings.HasPrefix(lv, "tmp-") ||
+			(strings.HasPrefix(lv, "layer-") && !layers[strings.TrimPrefix(lv, "layer-")]) {
+			if err := lvmRemoveLV(s.c, lv); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Read the runtime config which was unpacked next to the rootfs.
+func readBundleSpec(bundle string) (*rspec.Spec, error) {
+	contents, err := ioutil.ReadFile(filepath.Join(bundle, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	spec := &rspec.Spec{}
+	if err := json.Unmarshal(contents, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// Quote arg for lxc.init.cmd, which lxc splits on whitespace outside
+// single or double quotes.
+func lxcQuote(arg string) (string, error) {
+	switch {
+	case strings.Contains(arg, "\n"):
+		return "", fmt.Errorf("Can't pass %q to lxc: it has a newline", arg)
+	case arg != "" && !strings.ContainsAny(arg, " \t'\""):
+		return arg, nil
+	case !strings.Contains(arg, "'"):
+		return "'" + arg + "'", nil
+	case !strings.Contains(arg, "\""):
+		return "\"" + arg + "\"", nil
+	}
+	return "", fmt.Errorf("Can't pass %q to lxc: it has both kinds of quote", arg)
+}
+
+// Generate an lxc config which runs args as init of a container on
+// rootfs, in its own mount, pid, uts, ipc and network namespaces.  The
+// network namespace only gets a loopback device.
+func lxcConfig(name, rootfs string, spec *rspec.Spec, args []string) (string, error) {
+	quoted := []string{}
+	for _, arg := range args {
+		q, err := lxcQuote(arg)
+		if err != nil {
+			return "", err
+		}
+		quoted = append(quoted, q)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "lxc.uts.name = %s\n", name)
+	fmt.Fprintf(&buf, "lxc.rootfs.path = dir:%s\n", rootfs)
+	fmt.Fprintf(&buf, "lxc.net.0.type = empty\n")
+	fmt.Fprintf(&buf, "lxc.autodev = 1\n")
+	fmt.Fprintf(&buf, "lxc.mount.auto = proc:mixed sys:mixed cgroup:mixed\n")
+	fmt.Fprintf(&buf, "lxc.init.cmd = %s\n", strings.Join(quoted, " "))
+	if spec != nil && spec.Process != nil {
+		fmt.Fprintf(&buf, "lxc.init.uid = %d\n", spec.Process.User.UID)
+		fmt.Fprintf(&buf, "lxc.init.gid = %d\n", spec.Process.User.GID)
+		if spec.Process.Cwd != "" {
+			fmt.Fprintf(&buf, "lxc.init.cwd = %s\n", spec.Process.Cwd)
+		}
+		for _, e := range spec.Process.Env {
+			fmt.Fprintf(&buf, "lxc.environment = %s\n", e)
+		}
+	}
+	return buf.String(), nil
+}
+
+// Start a container on the checked-out rootfs, running args, or the
+// image's entrypoint and cmd if args is empty, as its PID 1.
+func RunLxc(c *stackerConfig, args []string) error {
+	if !dirExists(c.RootfsDir()) {
+		return fmt.Errorf("%s does not exist, nothing checked out?", c.RootfsDir())
+	}
+	rootfs, err := filepath.Abs(c.RootfsDir())
+	if err != nil {
+		return err
+	}
+
+	spec, err := readBundleSpec(c.UnpackDir())
+	if err != nil {
+		return fmt.Errorf("Failed reading image config: %v", err)
+	}
+	if len(args) == 0 && spec.Process != nil {
+		args = spec.Process.Args
+	}
+	if len(args) == 0 {
+		args = []string{"/bin/sh"}
+	}
+
+	lxcpath, err := ioutil.TempDir("", "stacker_lxc_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(lxcpath)
+
+	name := fmt.Sprintf("stacker-%d", os.Getpid())
+	confFile := filepath.Join(lxcpath, "config")
+	conf, err := lxcConfig(name, rootfs, spec, args)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(confFile, []byte(conf), 0644); err != nil {
+		return err
+	}
+
+	// Unlike lxc-execute, lxc-start runs lxc.init.cmd itself as PID 1
+	// rather than under lxc's own init.
+	cmd := exec.Command("lxc-start", "-F", "-n", name, "-P", lxcpath, "-f", confFile)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
@@ -0,0 +1,171 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/openSUSE/umoci/oci/cas/dir"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// Open the OCI layout at ociDir.  The caller must Close() the engine.
+func openOCI(ociDir string) (casext.Engine, error) {
+	image, err := dir.Open(ociDir)
+	if err != nil {
+		return casext.Engine{}, err
+	}
+	return casext.NewEngine(image), nil
+}
+
+// Return the descriptor of the manifest tag points at.
+func resolveTag(ctx context.Context, engine casext.Engine, tag string) (ispec.Descriptor, error) {
+	paths, err := engine.ResolveReference(ctx, tag)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	switch len(paths) {
+	case 0:
+		return ispec.Descriptor{}, fmt.Errorf("Tag %s not found", tag)
+	case 1:
+	default:
+		return ispec.Descriptor{}, fmt.Errorf("Tag %s is ambiguous (%d manifests)", tag, len(paths))
+	}
+	desc := paths[0].Descriptor()
+	if desc.MediaType != ispec.MediaTypeImageManifest {
+		return ispec.Descriptor{}, fmt.Errorf("Tag %s is a %s, not a manifest", tag, desc.MediaType)
+	}
+	return desc, nil
+}
+
+func readManifest(ctx context.Context, engine casext.Engine, desc ispec.Descriptor) (ispec.Manifest, error) {
+	blob, err := engine.FromDescriptor(ctx, desc)
+	if err != nil {
+		return ispec.Manifest{}, err
+	}
+	defer blob.Close()
+	manifest, ok := blob.Data.(ispec.Manifest)
+	if !ok {
+		return ispec.Manifest{}, fmt.Errorf("%s is not a manifest", desc.Digest)
+	}
+	return manifest, nil
+}
+
+func readImageConfig(ctx context.Context, engine casext.Engine, manifest ispec.Manifest) (ispec.Image, error) {
+	blob, err := engine.FromDescriptor(ctx, manifest.Config)
+	if err != nil {
+		return ispec.Image{}, err
+	}
+	defer blob.Close()
+	config, ok := blob.Data.(ispec.Image)
+	if !ok {
+		return ispec.Image{}, fmt.Errorf("%s is not an image config", manifest.Config.Digest)
+	}
+	return config, nil
+}
+
+// Return the manifest descriptor and manifest for tag.
+func tagManifest(ctx context.Context, engine casext.Engine, tag string) (ispec.Descriptor, ispec.Manifest, error) {
+	desc, err := resolveTag(ctx, engine, tag)
+	if err != nil {
+		return desc, ispec.Manifest{}, err
+	}
+	manifest, err := readManifest(ctx, engine, desc)
+	return desc, manifest, err
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	blob io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.blob.Close()
+}
+
+// Return an uncompressed tar stream for the layer desc.
+func layerReader(ctx context.Context, engine casext.Engine, desc ispec.Descriptor) (io.ReadCloser, error) {
+	blob, err := engine.GetBlob(ctx, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	switch desc.MediaType {
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerNonDistributable:
+		return blob, nil
+	case ispec.MediaTypeImageLayerGzip, ispec.MediaTypeImageLayerNonDistributableGzip:
+		zr, err := gzip.NewReader(blob)
+		if err != nil {
+			blob.Close()
+			return nil, err
+		}
+		return gzipReadCloser{zr, blob}, nil
+	default:
+		blob.Close()
+		return nil, fmt.Errorf("Unsupported layer media type %s", desc.MediaType)
+	}
+}
+
+// Point tag at a new image with no layers.
+func newEmptyImage(ctx context.Context, engine casext.Engine, tag string) error {
+	now := time.Now()
+	config := ispec.Image{
+		Created:      &now,
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS:       ispec.RootFS{Type: "layers"},
+	}
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	manifest := ispec.Manifest{
+		Config: ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []ispec.Descriptor{},
+	}
+	manifest.SchemaVersion = 2
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return err
+	}
+
+	return engine.UpdateReference(ctx, tag, ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	})
+}
+
+// Apply the layer l on top of the filesystem at dest.
+func applyLayer(ctx context.Context, engine casext.Engine, l ispec.Descriptor, dest string) error {
+	reader, err := layerReader(ctx, engine, l)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return layer.UnpackLayer(dest, reader, layerMapOptions())
+}
@@ -0,0 +1,273 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// The overlay driver unpacks every OCI layer once, into its own
+// directory under <basedir>/overlay/layers named by digest, with OCI
+// whiteouts converted to overlayfs ones.  A checkout mounts overlayfs on
+// the unpack dir's rootfs with the image's layer directories as
+// lowerdirs and a fresh upperdir, so at checkin the upperdir is exactly
+// the new layer.
+type overlayStorage struct {
+	c *stackerConfig
+}
+
+func init() {
+	registerStorage("overlay", func(c *stackerConfig) Storage { return &overlayStorage{c} })
+}
+
+func overlayLayersDir(c *stackerConfig) string {
+	return filepath.Join(c.BaseDir, "overlay", "layers")
+}
+
+func overlayUpperDir(c *stackerConfig) string {
+	return filepath.Join(c.UnpackDir(), "upper")
+}
+
+func overlayWorkDir(c *stackerConfig) string {
+	return filepath.Join(c.UnpackDir(), "work")
+}
+
+// Unpack the layer l into its directory, if that hasn't been done yet.
+// Layers are unpacked to a temporary name and renamed when complete.
+func overlayUnpackLayer(ctx context.Context, engine casext.Engine, c *stackerConfig, l ispec.Descriptor) (string, error) {
+	dest := filepath.Join(overlayLayersDir(c), l.Digest.Encoded())
+	if dirExists(dest) {
+		return dest, nil
+	}
+
+	tmp := dest + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return "", err
+	}
+	reader, err := layerReader(ctx, engine, l)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	if err := extractTar(reader, tmp, extractOptions{overlayWhiteouts: true}); err != nil {
+		os.RemoveAll(tmp)
+		return "", fmt.Errorf("Failed unpacking layer %s: %v", l.Digest, err)
+	}
+	return dest, os.Rename(tmp, dest)
+}
+
+// Unpack every layer of manifest, returning the layer directories
+// topmost first, as overlayfs wants them.
+func overlayUnpackLayers(ctx context.Context, engine casext.Engine, c *stackerConfig, manifest ispec.Manifest) ([]string, error) {
+	dirs := []string{}
+	for _, l := range manifest.Layers {
+		dir, err := overlayUnpackLayer(ctx, engine, c, l)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append([]string{dir}, dirs...)
+	}
+	return dirs, nil
+}
+
+func (s *overlayStorage) Unpack() error {
+	return forEachTagManifest(s.c, func(ctx context.Context, engine casext.Engine, manifest ispec.Manifest) error {
+		_, err := overlayUnpackLayers(ctx, engine, s.c, manifest)
+		return err
+	})
+}
+
+func (s *overlayStorage) Checkout(tag string) error {
+	engine, err := openOCI(s.c.OciDir)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+	ctx := context.Background()
+
+	desc, manifest, err := tagManifest(ctx, engine, tag)
+	if err != nil {
+		return err
+	}
+	lowers, err := overlayUnpackLayers(ctx, engine, s.c, manifest)
+	if err != nil {
+		return err
+	}
+	if len(lowers) == 0 {
+		// overlayfs needs at least one lowerdir.
+		empty := filepath.Join(s.c.BaseDir, "overlay", "empty")
+		if err := os.MkdirAll(empty, 0755); err != nil {
+			return err
+		}
+		lowers = []string{empty}
+	}
+
+	for _, d := range []string{overlayUpperDir(s.c), overlayWorkDir(s.c), s.c.RootfsDir()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			os.RemoveAll(s.c.UnpackDir())
+			return err
+		}
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(lowers, ":"), overlayUpperDir(s.c), overlayWorkDir(s.c))
+	// The kernel takes at most a page of mount options.
+	if len(opts) >= os.Getpagesize() {
+		os.RemoveAll(s.c.UnpackDir())
+		return fmt.Errorf("%s has too many layers (%d) to mount with overlay: the mount options would be %d bytes, the limit is %d",
+			tag, len(lowers), len(opts), os.Getpagesize()-1)
+	}
+	if err := syscall.Mount("overlay", s.c.RootfsDir(), "overlay", 0, opts); err != nil {
+		os.RemoveAll(s.c.UnpackDir())
+		return fmt.Errorf("Failed mounting overlay: %v", err)
+	}
+
+	if err := finishBundle(ctx, engine, s.c.UnpackDir(), desc, manifest); err != nil {
+		s.Abort()
+		return err
+	}
+	return nil
+}
+
+// Check in the upperdir as a new layer on top of the checked-out image.
+// The upperdir is then kept as that layer's directory, so it never
+// needs unpacking.
+func (s *overlayStorage) Checkin(tag string, from ispec.Descriptor, update *imageUpdate) error {
+	upper := overlayUpperDir(s.c)
+	var reader io.Reader
+	if entries, err := ioutil.ReadDir(upper); err != nil {
+		return err
+	} else if len(entries) > 0 {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(writeOverlayLayer(pw, upper))
+		}()
+		defer pr.Close()
+		reader = pr
+	}
+
+	newDesc, err := commitLayer(s.c.OciDir, tag, from, reader, update)
+	if err != nil {
+		return err
+	}
+	// Only unmount once the layer is committed, so that if that fails
+	// the checkout is still usable.
+	if IsMountpoint(s.c.RootfsDir()) {
+		if err := syscall.Unmount(s.c.RootfsDir(), 0); err != nil {
+			return err
+		}
+	}
+
+	if reader != nil {
+		engine, err := openOCI(s.c.OciDir)
+		if err != nil {
+			return err
+		}
+		defer engine.Close()
+		manifest, err := readManifest(context.Background(), engine, newDesc)
+		if err == nil && len(manifest.Layers) > 0 {
+			top := manifest.Layers[len(manifest.Layers)-1]
+			dest := filepath.Join(overlayLayersDir(s.c), top.Digest.Encoded())
+			if !dirExists(dest) {
+				os.Rename(upper, dest)
+			}
+		}
+	}
+	return os.RemoveAll(s.c.UnpackDir())
+}
+
+// Unmount the overlay and remove the unpack dir, upperdir and all.
+func (s *overlayStorage) Abort() error {
+	if IsMountpoint(s.c.RootfsDir()) {
+		if err := syscall.Unmount(s.c.RootfsDir(), 0); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(s.c.UnpackDir())
+}
+
+func (s *overlayStorage) Setup() error {
+	return fmt.Errorf("Loopback setup not supported for overlay")
+}
+
+func (s *overlayStorage) Teardown() error {
+	return fmt.Errorf("Loopback setup not supported for overlay")
+}
+
+func (s *overlayStorage) RootfsPath() string {
+	return s.c.BaseDir + "/unpacked" + s.c.checkoutSuffix() + "/rootfs"
+}
+
+func (s *overlayStorage) Describe(w io.Writer) {
+	fmt.Fprintf(w, "  layers: %s\n", overlayLayersDir(s.c))
+}
+
+func (s *overlayStorage) Health() storageHealth {
+	h := storageHealth{}
+	h.Used, h.Size = statfsUsage(s.c.BaseDir)
+	return h
+}
+
+// Anything at all in the upperdir is a change.
+func (s *overlayStorage) Dirty() (bool, error) {
+	entries, err := ioutil.ReadDir(overlayUpperDir(s.c))
+	return len(entries) > 0, err
+}
+
+// Remove layer directories no tag uses, and any left over from an
+// interrupted unpack.  Layers a checkout has mounted stay, even if their
+// tag has gone.
+func (s *overlayStorage) GC() error {
+	layers, err := referencedLayers(s.c)
+	if err != nil {
+		return err
+	}
+	recs, err := s.c.checkoutRecords()
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		for _, l := range rec.Layers {
+			layers[l.Digest.Encoded()] = true
+		}
+	}
+	entries, err := ioutil.ReadDir(overlayLayersDir(s.c))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if !layers[e.Name()] {
+			if err := os.RemoveAll(filepath.Join(overlayLayersDir(s.c), e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
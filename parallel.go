@@ -0,0 +1,166 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var checkoutMutex sync.Mutex
+
+// Serializes whole lines from all prefixWriters onto their outputs.
+var outputMutex sync.Mutex
+
+// A writer which prefixes every line written to it with the name of the
+// target being built, so the output of concurrent builds can be told
+// apart.  Only complete lines are passed on; Flush writes any remainder.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+	mu     sync.Mutex
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, name string) *prefixWriter {
+	return &prefixWriter{prefix: "[" + name + "] ", w: w}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		p.writeLine(p.buf[:i+1])
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+func (p *prefixWriter) writeLine(line []byte) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	p.w.Write(append([]byte(p.prefix), line...))
+}
+
+func (p *prefixWriter) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) > 0 {
+		p.writeLine(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+var checkoutNameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_.+-]`)
+
+// Name a target's checkout area so it is usable as a file, dataset and
+// LV name.
+func checkoutNameFor(target string) string {
+	return "build-" + checkoutNameUnsafe.ReplaceAllString(target, "_")
+}
+
+// Build the targets in order, running up to opts.jobs of them at once.
+// A target starts once its base (if that is a target in this recipe) is
+// built, and is skipped if its base failed.  Each target is checked out
+// in its own area, and its output is prefixed with its name.
+func (c *stackerConfig) buildParallel(order []buildTarget, recipeDir string, cache *buildCache, opts buildOptions) error {
+	done := map[string]chan struct{}{}
+	for _, t := range order {
+		done[t.target] = make(chan struct{})
+	}
+
+	var mu sync.Mutex
+	failed := map[string]bool{}
+	errs := []string{}
+	sem := make(chan struct{}, opts.jobs)
+	var wg sync.WaitGroup
+
+	for i := range order {
+		t := order[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[t.target])
+
+			if baseDone, ok := done[t.base]; ok {
+				<-baseDone
+				mu.Lock()
+				baseFailed := failed[t.base]
+				if baseFailed {
+					failed[t.target] = true
+				}
+				mu.Unlock()
+				if baseFailed {
+					return
+				}
+			}
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			tc := *c
+			tc.checkoutName = checkoutNameFor(t.target)
+			out := newPrefixWriter(os.Stdout, t.target)
+			err := tc.clearStaleBuildArea(out)
+			if err == nil {
+				err = tc.buildCached(&t, recipeDir, cache, opts, out)
+			}
+			if err != nil {
+				fmt.Fprintf(out, "Failed: %v\n", err)
+			}
+			out.Flush()
+
+			if err != nil {
+				mu.Lock()
+				failed[t.target] = true
+				errs = append(errs, fmt.Sprintf("Error building %s: %v", t.target, err))
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		skipped := len(failed) - len(errs)
+		msg := strings.Join(errs, "; ")
+		if skipped > 0 {
+			msg = fmt.Sprintf("%s (and %d targets skipped)", msg, skipped)
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// A killed parallel build leaves its targets' checkout areas behind;
+// as only builds use them, they can simply be thrown away.
+func (c *stackerConfig) clearStaleBuildArea(out io.Writer) error {
+	rec, err := c.readCheckoutRecord()
+	if err != nil || rec == nil || !rec.Stale() {
+		return err
+	}
+	fmt.Fprintf(out, "Removing checkout left behind by killed process %d\n", rec.PID)
+	_, err = c.AbortCheckout(true)
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Print what building order would do: where each target's base comes
+// from, and whether the build cache would be used.  A target based on
+// another target can only be a cache hit if its base is one too, as
+// otherwise its base's digest is not known until it is built.
+func (c *stackerConfig) printBuildPlan(order []buildTarget, recipe *buildRecipe, recipeDir string, cache *buildCache, opts buildOptions) error {
+	planned := map[string]string{}
+
+	fmt.Printf("Build plan (%d targets):\n", len(order))
+	for i := range order {
+		t := &order[i]
+		var base, source string
+		baseKnown := true
+		switch {
+		case t.base == "empty":
+			base, source = "empty", "empty image"
+		case recipe.HasTarget(t.base):
+			source = "recipe target"
+			base, baseKnown = planned[t.base]
+		default:
+			source = "OCI tag"
+			var err error
+			if base, err = c.cacheBase(t); err != nil {
+				return fmt.Errorf("Error resolving base of %s: %v", t.target, err)
+			}
+		}
+
+		action := "build"
+		switch {
+		case opts.noCache:
+			action = "build (cache disabled)"
+		case !baseKnown:
+			action = "build (base is rebuilt)"
+		default:
+			key, err := buildCacheKey(t, base, recipeDir)
+			if err != nil {
+				return fmt.Errorf("Error planning %s: %v", t.target, err)
+			}
+			if desc, ok := c.cachedImage(cache, key, false); ok {
+				action = "cached " + desc.Digest.String()
+				planned[t.target] = desc.Digest.String()
+			}
+		}
+		fmt.Printf("%3d. %s: base %s (%s), %s\n", i+1, t.target, t.base, source, action)
+	}
+	return nil
+}
+
+// A node of the recipe's dependency graph: a target, or an image a
+// target is based on which the recipe does not build.
+type graphNode struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+type graphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type recipeGraph struct {
+	Nodes []graphNode `json:"nodes"`
+	Edges []graphEdge `json:"edges"`
+}
+
+// Return the graph of the recipe's targets, with an edge from each base
+// to the targets built on it.  Targets based on the empty image have no
+// incoming edge.
+func (r *buildRecipe) Graph() recipeGraph {
+	g := recipeGraph{Nodes: []graphNode{}, Edges: []graphEdge{}}
+	images := map[string]bool{}
+	for _, t := range r.Targets {
+		g.Nodes = append(g.Nodes, graphNode{Name: t.target, Kind: "target"})
+	}
+	for _, t := range r.Targets {
+		if t.base == "empty" || t.base == "" {
+			continue
+		}
+		if !r.HasTarget(t.base) && !images[t.base] {
+			images[t.base] = true
+			g.Nodes = append(g.Nodes, graphNode{Name: t.base, Kind: "image"})
+		}
+		g.Edges = append(g.Edges, graphEdge{From: t.base, To: t.target})
+	}
+	return g
+}
+
+func (g recipeGraph) WriteDot(w io.Writer) {
+	fmt.Fprintf(w, "digraph recipe {\n")
+	for _, n := range g.Nodes {
+		shape := "box"
+		if n.Kind == "image" {
+			shape = "ellipse"
+		}
+		fmt.Fprintf(w, "\t%s [shape=%s];\n", strconv.Quote(n.Name), shape)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(w, "\t%s -> %s;\n", strconv.Quote(e.From), strconv.Quote(e.To))
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+func (g recipeGraph) WriteJSON(w io.Writer) error {
+	out, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", out)
+	return err
+}
@@ -17,6 +17,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 )
 
 func FileExists(dir string) bool {
@@ -47,30 +49,36 @@ func usage() {
 	fmt.Printf("Usage: %s [COMMAND] [ARGUMENTS]\n", os.Args[0])
 	fmt.Printf("Commands\n")
 	fmt.Printf("   abort [-f]: remove the checked-out rootfs\n")
-	fmt.Printf("   build BUILDFILE: build OCI tags per the recipe in BUILDFILE\n")
+	fmt.Printf("   build [--no-cache] [-j N] [--target NAME]... [--deps-only] [--dry-run] BUILDFILE:\n")
+	fmt.Printf("       build OCI tags per the recipe in BUILDFILE, or only the named targets\n")
+	fmt.Printf("       and their bases (with --deps-only, only their bases).  --dry-run\n")
+	fmt.Printf("       prints the build plan instead\n")
+	fmt.Printf("   cache ls: list the build cache\n")
+	fmt.Printf("   cache prune [--all]: forget cached builds no tag points to (or all of them)\n")
 	fmt.Printf("   checkin NEWTAG: check in the checked-out rootfs as NEWTAG\n")
 	fmt.Printf("   checkout TAG: check out the rootfs for OCI tag TAG\n")
 	fmt.Printf("   config show: show current configuration\n")
-	fmt.Printf("   chroot: run a chroot in checked-out fs\n")
+	fmt.Printf("   gc: remove unpacked layers no longer used by any tag\n")
+	fmt.Printf("   graph [--json] BUILDFILE: print the recipe's dependency graph in DOT (or JSON)\n")
+	fmt.Printf("   chroot [-- CMD [ARGS]]: run CMD (default a shell) in a chroot in checked-out fs\n")
 	fmt.Printf("   ls: list the OCi tags\n")
-	fmt.Printf("   lxc: open a container in checked-out fs\n")
+	fmt.Printf("   lxc [-- CMD [ARGS]]: open a container in checked-out fs\n")
 	fmt.Printf("   losetup: set up loopback for configured fstype\n")
 	fmt.Printf("   lounsetup: undo loopback setup for configured fstype\n")
+	fmt.Printf("   status [--json]: show checkout and storage state\n")
 }
 
+// Kept referenced so its file isn't closed, dropping the lock, when it
+// is garbage collected.
+var baseDirLock *fileLock
+
 var config = &stackerConfig{
 	BaseDir: ".",
 	OciDir: "./oci",
 	FsType: "vfs",
+	LockTimeout: "60s",
 }
 
-// Unpack and repack operations.  These will be used by build,
-// unpack, checkout and checkin.
-// Obviously these are to be replaced with actual use of the 
-// umoci/oci libraries.
-
-// copied from umoci's stat code.  This should all be replaced with some
-// simple API calls.
 func doLs(c *stackerConfig) bool {
 	names, err := c.ListTags()
 	if err != nil {
@@ -110,6 +118,20 @@ func Checkout(c *stackerConfig) bool {
 	return c.CheckoutTag(tag)
 }
 
+func Checkin(c *stackerConfig) bool {
+	if len(os.Args) < 3 {
+		usage()
+		return false
+	}
+	tag := os.Args[2]
+
+	if err := c.CheckinTag(tag, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Checkin failed: %v\n", err)
+		return false
+	}
+	return true
+}
+
 func Abort(c *stackerConfig) bool {
 	force := false
 	if len(os.Args) > 2 && (os.Args[2] == "-f"  || os.Args[2] == "--force") {
@@ -123,16 +145,147 @@ func Abort(c *stackerConfig) bool {
 	return !failed
 }
 
-// Build a recipe
-func Build(c *stackerConfig) bool {
+func Graph() bool {
+	asJSON := false
+	buildFile := ""
+	for _, arg := range os.Args[2:] {
+		switch {
+		case arg == "--json":
+			asJSON = true
+		case buildFile == "":
+			buildFile = arg
+		default:
+			usage()
+			return false
+		}
+	}
+	if buildFile == "" {
+		usage()
+		return false
+	}
+
+	recipe, err := readRecipe(buildFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return false
+	}
+	g := recipe.Graph()
+	if asJSON {
+		if err := g.WriteJSON(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return false
+		}
+	} else {
+		g.WriteDot(os.Stdout)
+	}
+	return true
+}
+
+func doCache(c *stackerConfig) bool {
 	if len(os.Args) < 3 {
 		usage()
 		return false
 	}
+	var err error
+	switch os.Args[2] {
+	case "ls":
+		err = c.CacheList()
+	case "prune":
+		all := len(os.Args) > 3 && os.Args[3] == "--all"
+		lock, lerr := c.LockBaseDir()
+		if lerr != nil {
+			err = lerr
+			break
+		}
+		err = c.CachePrune(all)
+		lock.Unlock()
+	default:
+		usage()
+		return false
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return false
+	}
+	return true
+}
+
+func Chroot(c *stackerConfig) bool {
+	args := os.Args[2:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	if err := RunInChroot(c.RootfsDir(), args); err != nil {
+		fmt.Fprintf(os.Stderr, "Chroot failed: %v\n", err)
+		return false
+	}
+	return true
+}
+
+func Lxc(c *stackerConfig) bool {
+	args := os.Args[2:]
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
 
-	buildFile := os.Args[2]
+	if err := RunLxc(c, args); err != nil {
+		fmt.Fprintf(os.Stderr, "Container failed: %v\n", err)
+		return false
+	}
+	return true
+}
 
-	err := c.Build(buildFile)
+// Build a recipe
+func Build(c *stackerConfig) bool {
+	opts := buildOptions{jobs: 1}
+	buildFile := ""
+	args := os.Args[2:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--no-cache":
+			opts.noCache = true
+		case arg == "--target":
+			if i+1 == len(args) {
+				usage()
+				return false
+			}
+			i++
+			opts.targets = append(opts.targets, args[i])
+		case arg == "--deps-only":
+			opts.depsOnly = true
+		case arg == "--dry-run":
+			opts.dryRun = true
+		case strings.HasPrefix(arg, "-j"):
+			n := strings.TrimPrefix(arg, "-j")
+			if n == "" && i+1 < len(args) {
+				i++
+				n = args[i]
+			}
+			jobs, err := strconv.Atoi(n)
+			if err != nil || jobs < 1 {
+				fmt.Fprintf(os.Stderr, "Bad job count: %s\n", n)
+				return false
+			}
+			opts.jobs = jobs
+		case buildFile == "":
+			buildFile = arg
+		default:
+			usage()
+			return false
+		}
+	}
+	if buildFile == "" {
+		usage()
+		return false
+	}
+	if opts.depsOnly && len(opts.targets) == 0 {
+		fmt.Fprintf(os.Stderr, "--deps-only needs at least one --target\n")
+		return false
+	}
+
+	err := c.Build(buildFile, opts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Build error: %v\n", err)
 		return false
@@ -146,10 +299,35 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := joinUserNS(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	if err := config.Initialize(); err != nil {
 		os.Exit(1)
 	}
 
+	// Unprivileged users get a user namespace to be root in.
+	if os.Geteuid() != 0 && userNSCommands[os.Args[1]] {
+		code, err := runInUserNS(config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+		os.Exit(code)
+	}
+
+	// Commands which change BaseDir, or use the checkout in it, hold its
+	// lock until they exit, when the kernel releases it.
+	switch os.Args[1] {
+	case "build", "checkout", "checkin", "abort", "chroot", "lxc", "losetup", "lounsetup", "gc", "unpack":
+		var err error
+		if baseDirLock, err = config.LockBaseDir(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	switch os.Args[1] {
 	case "build":
 		if !Build(config) {
@@ -166,10 +344,30 @@ func main() {
 		if !doConfig() {
 			os.Exit(1)
 		}
+	case "graph":
+		if !Graph() {
+			os.Exit(1)
+		}
+	case "cache":
+		if !doCache(config) {
+			os.Exit(1)
+		}
 	case "checkout":
 		if !Checkout(config) {
 			os.Exit(1)
 		}
+	case "checkin":
+		if !Checkin(config) {
+			os.Exit(1)
+		}
+	case "chroot":
+		if !Chroot(config) {
+			os.Exit(1)
+		}
+	case "lxc":
+		if !Lxc(config) {
+			os.Exit(1)
+		}
 	case "abort":
 		if !Abort(config) {
 			os.Exit(1)
@@ -184,6 +382,15 @@ func main() {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(1)
 		}
+	case "status":
+		if !doStatus(config) {
+			os.Exit(1)
+		}
+	case "gc":
+		if err := config.GC(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	case "unpack":
 		if err := config.Unpack(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
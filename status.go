@@ -0,0 +1,175 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+type checkoutStatus struct {
+	Path    string    `json:"path"`
+	Tag     string    `json:"tag,omitempty"`
+	Digest  string    `json:"digest"`
+	Started time.Time `json:"started,omitempty"`
+	PID     int       `json:"pid,omitempty"`
+	Stale   bool      `json:"stale"`
+	Dirty   bool      `json:"dirty"`
+}
+
+type stackerStatus struct {
+	Driver   string          `json:"driver"`
+	BaseDir  string          `json:"basedir"`
+	OciDir   string          `json:"ocidir"`
+	OciBytes uint64          `json:"oci_bytes"`
+	Storage  storageHealth   `json:"storage"`
+	Checkout *checkoutStatus `json:"checkout"`
+}
+
+// Return the disk space used by the files under dir, counting hard
+// linked files once.
+func diskUsage(dir string) uint64 {
+	seen := map[uint64]bool{}
+	total := uint64(0)
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || seen[st.Ino] {
+			return nil
+		}
+		seen[st.Ino] = true
+		total += uint64(st.Blocks) * 512
+		return nil
+	})
+	return total
+}
+
+func (c *stackerConfig) Status() (*stackerStatus, error) {
+	s, err := c.Storage()
+	if err != nil {
+		return nil, err
+	}
+	st := &stackerStatus{
+		Driver:   c.FsType,
+		BaseDir:  c.BaseDir,
+		OciDir:   c.OciDir,
+		OciBytes: diskUsage(c.OciDir),
+		Storage:  s.Health(),
+	}
+
+	rec, err := c.readCheckoutRecord()
+	if err != nil {
+		return st, err
+	}
+	if rec == nil && !dirExists(c.UnpackDir()) {
+		return st, nil
+	}
+	st.Checkout = &checkoutStatus{Path: c.UnpackDir()}
+	if rec != nil {
+		st.Checkout.Tag = rec.Tag
+		st.Checkout.Started = rec.Started
+		st.Checkout.PID = rec.PID
+		st.Checkout.Stale = rec.Stale()
+	}
+	from, err := c.checkoutParent(rec)
+	if err != nil {
+		return st, fmt.Errorf("%s exists but is not a stacker checkout: %v", c.UnpackDir(), err)
+	}
+	st.Checkout.Digest = from.Digest.String()
+	if st.Checkout.Stale || !dirExists(c.UnpackDir()) {
+		return st, nil
+	}
+	if st.Checkout.Dirty, err = s.Dirty(); err != nil {
+		return st, fmt.Errorf("Failed checking for changes: %v", err)
+	}
+	return st, nil
+}
+
+func humanBytes(b uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	f := float64(b)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
+
+func (st *stackerStatus) Print(w io.Writer) {
+	fmt.Fprintf(w, "fs driver: %s\n", st.Driver)
+	fmt.Fprintf(w, "basedir: %s\n", st.BaseDir)
+	fmt.Fprintf(w, "ocidir: %s (%s)\n", st.OciDir, humanBytes(st.OciBytes))
+	if st.Storage.LoFile != "" {
+		fmt.Fprintf(w, "loopback file: %s (exists: %v, mounted: %v)\n",
+			st.Storage.LoFile, st.Storage.LoFileExists, st.Storage.Mounted)
+	}
+	if st.Storage.Size != 0 {
+		fmt.Fprintf(w, "storage: %s used of %s\n", humanBytes(st.Storage.Used), humanBytes(st.Storage.Size))
+	}
+	if st.Checkout == nil {
+		fmt.Fprintf(w, "checkout: none\n")
+		return
+	}
+	tag := st.Checkout.Tag
+	if tag == "" {
+		tag = "(unknown)"
+	}
+	fmt.Fprintf(w, "checkout: %s\n", st.Checkout.Path)
+	fmt.Fprintf(w, "  tag: %s\n", tag)
+	fmt.Fprintf(w, "  digest: %s\n", st.Checkout.Digest)
+	if !st.Checkout.Started.IsZero() {
+		fmt.Fprintf(w, "  started: %s\n", st.Checkout.Started.Format(time.RFC3339))
+	}
+	if st.Checkout.Stale {
+		fmt.Fprintf(w, "  stale: left behind by killed process %d, run abort\n", st.Checkout.PID)
+		return
+	} else if st.Checkout.PID != 0 {
+		fmt.Fprintf(w, "  in use by process %d\n", st.Checkout.PID)
+	}
+	fmt.Fprintf(w, "  uncommitted changes: %v\n", st.Checkout.Dirty)
+}
+
+func doStatus(c *stackerConfig) bool {
+	asJSON := len(os.Args) > 2 && os.Args[2] == "--json"
+
+	st, err := c.Status()
+	if st == nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return false
+	}
+	if asJSON {
+		out, jerr := json.MarshalIndent(st, "", "  ")
+		if jerr != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", jerr)
+			return false
+		}
+		fmt.Println(string(out))
+	} else {
+		st.Print(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return false
+	}
+	return true
+}
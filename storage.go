@@ -0,0 +1,187 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"syscall"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// A Storage driver implements checkouts and checkins on top of one kind
+// of filesystem.  Each driver registers itself under its fstype with
+// registerStorage.
+type Storage interface {
+	// Create and mount whatever backing store (e.g. a loopback file)
+	// the driver needs.
+	Setup() error
+	// Undo Setup, destroying the backing store.
+	Teardown() error
+	// Check out tag as a bundle whose rootfs is RootfsPath().
+	Checkout(tag string) error
+	// Throw away the current checkout.
+	Abort() error
+	// Check in the current checkout, which was made from the image
+	// from, as tag, applying update (if set) in the same commit, and
+	// clear the checkout.
+	Checkin(tag string, from ispec.Descriptor, update *imageUpdate) error
+	// The path of the checked-out rootfs.  Its parent directory holds
+	// the rest of the bundle.
+	RootfsPath() string
+	// Print the driver's configuration.
+	Describe(w io.Writer)
+	// Report on the driver's backing store.
+	Health() storageHealth
+	// Whether the current checkout differs from what was checked out.
+	Dirty() (bool, error)
+	// Unpack the layers of every tag ahead of time.
+	Unpack() error
+	// Remove unpacked layers which no tag refers to any more.
+	GC() error
+}
+
+// The state of a driver's backing store.  Drivers without a loopback
+// file leave LoFile empty.
+type storageHealth struct {
+	LoFile       string `json:"lofile,omitempty"`
+	LoFileExists bool   `json:"lofile_exists"`
+	Mounted      bool   `json:"mounted"`
+	Used         uint64 `json:"used_bytes"`
+	Size         uint64 `json:"size_bytes"`
+}
+
+// Return the bytes used on, and the total size of, the filesystem
+// holding path.
+func statfsUsage(path string) (used uint64, size uint64) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return 0, 0
+	}
+	size = fs.Blocks * uint64(fs.Bsize)
+	used = (fs.Blocks - fs.Bfree) * uint64(fs.Bsize)
+	return used, size
+}
+
+var storageDrivers = map[string]func(c *stackerConfig) Storage{}
+
+func registerStorage(fstype string, newDriver func(c *stackerConfig) Storage) {
+	storageDrivers[fstype] = newDriver
+}
+
+func storageTypes() []string {
+	types := []string{}
+	for t := range storageDrivers {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Return the storage driver for the configured fstype.
+func (c *stackerConfig) Storage() (Storage, error) {
+	newDriver, ok := storageDrivers[c.FsType]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported fs type %s (supported: %v)", c.FsType, storageTypes())
+	}
+	return newDriver(c), nil
+}
+
+// Return the encoded digests of every layer used by any tag.
+func referencedLayers(c *stackerConfig) (map[string]bool, error) {
+	layers := map[string]bool{}
+	err := forEachTagManifest(c, func(ctx context.Context, engine casext.Engine, manifest ispec.Manifest) error {
+		for _, l := range manifest.Layers {
+			layers[l.Digest.Encoded()] = true
+		}
+		return nil
+	})
+	return layers, err
+}
+
+// Return the encoded chain IDs of manifest's layers, in order.  Like
+// the OCI chain ID, which is worked out from diff IDs, a layer's chain ID
+// here identifies it together with every layer below it, so it can name
+// the filesystem the layers make up.
+func layerChainIDs(manifest ispec.Manifest) []string {
+	ids := []string{}
+	chain := ""
+	for _, l := range manifest.Layers {
+		if chain == "" {
+			chain = l.Digest.Encoded()
+		} else {
+			sum := sha256.Sum256([]byte("sha256:" + chain + " " + l.Digest.String()))
+			chain = hex.EncodeToString(sum[:])
+		}
+		ids = append(ids, chain)
+	}
+	return ids
+}
+
+// Return the encoded chain IDs of every layer used by any tag.
+func referencedChains(c *stackerConfig) (map[string]bool, error) {
+	chains := map[string]bool{}
+	err := forEachTagManifest(c, func(ctx context.Context, engine casext.Engine, manifest ispec.Manifest) error {
+		for _, id := range layerChainIDs(manifest) {
+			chains[id] = true
+		}
+		return nil
+	})
+	return chains, err
+}
+
+// Call fn with the manifest of every tag.
+func forEachTagManifest(c *stackerConfig, fn func(ctx context.Context, engine casext.Engine, manifest ispec.Manifest) error) error {
+	tags, err := c.ListTags()
+	if err != nil {
+		return err
+	}
+	engine, err := openOCI(c.OciDir)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+	ctx := context.Background()
+
+	for _, tag := range tags {
+		_, manifest, err := tagManifest(ctx, engine, tag)
+		if err != nil {
+			return err
+		}
+		if err := fn(ctx, engine, manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether name looks like an encoded sha256 layer digest or chain ID.
+func isLayerDigest(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
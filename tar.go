@@ -0,0 +1,461 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+	paxXattrPrefix     = "SCHILY.xattr."
+)
+
+type extractOptions struct {
+	// Turn OCI whiteouts into overlayfs whiteouts (0:0 char devices and
+	// opaque xattrs) instead of deleting what they refer to.
+	overlayWhiteouts bool
+	// We can't chown or create device nodes (see rootlessIDs), so
+	// extract everything as ourselves and skip devices.
+	rootless bool
+}
+
+// An archive to extract: a tar.Reader, or anything else which can
+// present its entries as tar headers, each followed by its contents.
+type archiveReader interface {
+	Next() (*tar.Header, error)
+	io.Reader
+}
+
+// The most symlinks resolving a single path may go through, as for the
+// kernel's MAXSYMLINKS.
+const maxSymlinks = 40
+
+// Resolve name, a path from an archive, to a path under root.  Symlinks
+// in the parent directories are followed, one component at a time, but
+// an entry which would land outside root, through ".." or through an
+// absolute or escaping symlink, is rejected.  The last component of name
+// is never followed, so the path returned is safe to remove or create.
+func resolveInRoot(root, name string) (string, error) {
+	return resolvePath(root, name, false)
+}
+
+// Resolve name under root as resolveInRoot does, except that if chroot
+// is set, symlinks are resolved as they would be after chrooting into
+// root: absolute symlinks are taken relative to root, and ".." in a
+// symlink never goes above it.
+func resolvePath(root, name string, chroot bool) (string, error) {
+	if rel := filepath.Clean(strings.TrimLeft(name, "/")); rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s escapes the rootfs", name)
+	}
+	rel := strings.TrimLeft(filepath.Clean("/"+name), "/")
+	if rel == "" {
+		return root, nil
+	}
+
+	// cur holds the components resolved so far, none of them a
+	// symlink; todo holds the components still to be resolved.
+	cur := []string{}
+	todo := strings.Split(rel, "/")
+	links := 0
+	for len(todo) > 0 {
+		c := todo[0]
+		todo = todo[1:]
+		switch {
+		case c == "" || c == ".":
+			continue
+		case c == "..":
+			if len(cur) == 0 {
+				if !chroot {
+					return "", fmt.Errorf("%s goes through a symlink which escapes the rootfs", name)
+				}
+				continue
+			}
+			cur = cur[:len(cur)-1]
+			continue
+		case len(todo) == 0:
+			cur = append(cur, c)
+			continue
+		}
+
+		p := filepath.Join(append(append([]string{root}, cur...), c)...)
+		fi, err := os.Lstat(p)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			cur = append(cur, c)
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("%s goes through too many symlinks", name)
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			if !chroot {
+				return "", fmt.Errorf("%s goes through absolute symlink %s -> %s", name, filepath.Join(append(cur, c)...), target)
+			}
+			cur = []string{}
+		}
+		todo = append(strings.Split(target, "/"), todo...)
+	}
+	return filepath.Join(append([]string{root}, cur...)...), nil
+}
+
+func setXattrs(path string, hdr *tar.Header) error {
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, paxXattrPrefix) {
+			continue
+		}
+		if err := unix.Lsetxattr(path, strings.TrimPrefix(k, paxXattrPrefix), []byte(v), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setTimes(path string, atime, mtime time.Time) error {
+	if atime.IsZero() {
+		atime = mtime
+	}
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// Apply a whiteout entry found at path.  extracted holds the paths which
+// came from this archive, which an opaque whiteout must leave alone.
+func applyWhiteout(path string, extracted map[string]bool, opts extractOptions) error {
+	dir, base := filepath.Split(path)
+	if base == whiteoutOpaque {
+		if opts.overlayWhiteouts {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+			return unix.Lsetxattr(dir, overlayOpaqueXattr, []byte("y"), 0)
+		}
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, e := range entries {
+			p := filepath.Join(dir, e.Name())
+			if !extracted[p] {
+				if err := os.RemoveAll(p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	victim := filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+	if err := os.RemoveAll(victim); err != nil {
+		return err
+	}
+	if opts.overlayWhiteouts {
+		return unix.Mknod(victim, unix.S_IFCHR, 0)
+	}
+	return nil
+}
+
+func extractEntry(r io.Reader, hdr *tar.Header, root string, path string, opts extractOptions) error {
+	mode := uint32(hdr.Mode) & 07777
+
+	// Anything in the way which isn't a directory we can reuse goes.
+	if fi, err := os.Lstat(path); err == nil {
+		if !fi.IsDir() || hdr.Typeflag != tar.TypeDir {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, os.FileMode(mode)); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := resolveInRoot(root, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			return err
+		}
+		// A hard link shares its target's metadata.
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if opts.rootless && hdr.Typeflag != tar.TypeFifo {
+			return nil
+		}
+		kind := map[byte]uint32{
+			tar.TypeChar:  unix.S_IFCHR,
+			tar.TypeBlock: unix.S_IFBLK,
+			tar.TypeFifo:  unix.S_IFIFO,
+		}[hdr.Typeflag]
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknod(path, kind|mode, int(dev)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported entry type %c", hdr.Typeflag)
+	}
+
+	if !opts.rootless {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if err := setXattrs(path, hdr); err != nil {
+		return err
+	}
+	// chown clears setuid bits, so set the mode afterwards.
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(path, os.FileMode(mode&0777)|modeBits(mode)); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		return setTimes(path, hdr.AccessTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// Convert the setuid, setgid and sticky bits of a unix mode to their
+// os.FileMode equivalents.
+func modeBits(mode uint32) os.FileMode {
+	m := os.FileMode(0)
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// Extract the tar stream r into root, preserving ownership, modes,
+// xattrs and device nodes, and applying whiteouts per opts.
+func extractTar(r io.Reader, root string, opts extractOptions) error {
+	return extractArchive(tar.NewReader(r), root, opts)
+}
+
+func extractArchive(tr archiveReader, root string, opts extractOptions) error {
+	extracted := map[string]bool{}
+	dirs := []*tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		path, err := resolveInRoot(root, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if path == root && hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		if strings.HasPrefix(filepath.Base(path), whiteoutPrefix) {
+			if err := applyWhiteout(path, extracted, opts); err != nil {
+				return fmt.Errorf("%s: %v", hdr.Name, err)
+			}
+			continue
+		}
+
+		if err := extractEntry(tr, hdr, root, path, opts); err != nil {
+			return fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+		extracted[path] = true
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+		}
+	}
+
+	// Extracting a directory's contents changes its mtime, so set
+	// directory times last.
+	for _, hdr := range dirs {
+		path, err := resolveInRoot(root, hdr.Name)
+		if err != nil {
+			return err
+		}
+		if err := setTimes(path, hdr.AccessTime, hdr.ModTime); err != nil {
+			return fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+func tarXattrs(path string, hdr *tar.Header) error {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		if err == unix.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" || strings.HasPrefix(name, "trusted.overlay.") {
+			continue
+		}
+		vsize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return err
+		}
+		val := make([]byte, vsize)
+		vsize, err = unix.Lgetxattr(path, name, val)
+		if err != nil {
+			return err
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[paxXattrPrefix+name] = string(val[:vsize])
+		hdr.Format = tar.FormatPAX
+	}
+	return nil
+}
+
+func isOverlayOpaque(path string) bool {
+	val := make([]byte, 1)
+	n, err := unix.Lgetxattr(path, overlayOpaqueXattr, val)
+	return err == nil && n == 1 && val[0] == 'y'
+}
+
+// Write an OCI layer for the overlayfs upper dir upper to w, turning
+// overlay whiteouts into OCI whiteouts.
+func writeOverlayLayer(w io.Writer, upper string) error {
+	tw := tar.NewWriter(w)
+	links := map[uint64]string{}
+	err := filepath.Walk(upper, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+
+		if fi.Mode()&os.ModeCharDevice != 0 && st.Rdev == 0 {
+			dir, base := filepath.Split(rel)
+			return tw.WriteHeader(&tar.Header{
+				Name:     dir + whiteoutPrefix + base,
+				Typeflag: tar.TypeReg,
+				ModTime:  fi.ModTime(),
+			})
+		}
+
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		hdr.Uname = ""
+		hdr.Gname = ""
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tarXattrs(path, hdr); err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := links[st.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+				return tw.WriteHeader(hdr)
+			}
+			links[st.Ino] = rel
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if fi.IsDir() && isOverlayOpaque(path) {
+			return tw.WriteHeader(&tar.Header{
+				Name:     rel + "/" + whiteoutOpaque,
+				Typeflag: tar.TypeReg,
+				ModTime:  fi.ModTime(),
+			})
+		}
+		if fi.Mode().IsRegular() {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,141 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "stacker-resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "usr/lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"lib":        "usr/lib",
+		"lib64":      "lib",
+		"etc":        "/private/etc",
+		"chain":      "etc",
+		"up":         "..",
+		"usr/up":     "..",
+		"usr/escape": "../..",
+		"usr/self":   ".",
+		"sneaky":     "usr/escape/etc",
+		"loop1":      "loop2",
+		"loop2":      "loop1",
+		"abslib":     "/usr/lib",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		want   string
+		chroot string
+	}{
+		{"", "", ""},
+		{"/", "", ""},
+		{"a/b", "a/b", "a/b"},
+		{"/a/../b", "b", "b"},
+		{"lib", "lib", "lib"},
+		{"lib/x", "usr/lib/x", "usr/lib/x"},
+		{"lib64/x", "usr/lib/x", "usr/lib/x"},
+		{"usr/self/self/lib/x", "usr/lib/x", "usr/lib/x"},
+		{"usr/up/lib/x", "usr/lib/x", "usr/lib/x"},
+		{"etc", "etc", "etc"},
+		{"etc/passwd", "!", "private/etc/passwd"},
+		{"chain/passwd", "!", "private/etc/passwd"},
+		{"abslib/x", "!", "usr/lib/x"},
+		{"up/x", "!", "x"},
+		{"usr/escape/x", "!", "x"},
+		{"sneaky/passwd", "!", "private/etc/passwd"},
+		{"../x", "!", "!"},
+		{"a/../../x", "!", "!"},
+		{"loop1/x", "!", "!"},
+	}
+	for _, test := range tests {
+		for _, chroot := range []bool{false, true} {
+			want := test.want
+			if chroot {
+				want = test.chroot
+			}
+			got, err := resolvePath(root, test.name, chroot)
+			if want == "!" {
+				if err == nil {
+					t.Errorf("resolving %q (chroot %v): got %s, wanted an error", test.name, chroot, got)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("resolving %q (chroot %v): %v", test.name, chroot, err)
+				continue
+			}
+			if got != filepath.Join(root, want) {
+				t.Errorf("resolving %q (chroot %v): got %s, wanted %s", test.name, chroot, got, filepath.Join(root, want))
+			}
+		}
+	}
+}
+
+// An archive must not be able to write outside the rootfs by chaining
+// symlinks, each of which looks harmless on its own.
+func TestExtractSymlinkChain(t *testing.T) {
+	root, err := ioutil.TempDir("", "stacker-extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "stacker-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "b", Typeflag: tar.TypeSymlink, Linkname: outside},
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+		{Name: "a/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte("evil"))
+		}
+	}
+	tw.Close()
+
+	if err := extractTar(&buf, root, extractOptions{rootless: true}); err == nil {
+		t.Errorf("extracting through a chain of symlinks succeeded")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "passwd")); err == nil {
+		t.Errorf("extraction wrote outside the rootfs")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/openSUSE/umoci/oci/layer"
+	"github.com/openSUSE/umoci/pkg/fseval"
+)
+
+// When run by an unprivileged user, stacker re-executes itself as root
+// in a new user and mount namespace.  If the user has ranges in
+// /etc/subuid and /etc/subgid, newuidmap and newgidmap map them in, so
+// images may own files as any user.  Otherwise only the user's own uid
+// is mapped (to root), and unpacking and repacking fall back to umoci's
+// rootless mode, which ignores ownership.
+//
+// The child learns which of the two it is through userNSEnv, and waits
+// on userNSSyncFd until the parent has written its id maps.  newuidmap
+// can only map a process which already exists, so in the mapped case
+// the child is exec'ed with its uid still unmapped, and the kernel drops
+// all its capabilities.  Once the maps are written it execs itself once
+// more, as root in the namespace, to get them back.
+const (
+	userNSEnv         = "STACKER_USERNS"
+	userNSMapped      = "mapped"
+	userNSMappedReady = "mapped-ready"
+	userNSSingle      = "single"
+	userNSSyncFd      = 3
+)
+
+// Whether we are running with only our own uid mapped.
+var rootlessIDs = false
+
+// The drivers which can work inside a user namespace.  btrfs needs the
+// filesystem set up by root beforehand (see losetup).
+var userNSDrivers = map[string]bool{
+	"vfs":   true,
+	"btrfs": true,
+}
+
+// Commands which need to run as (possibly namespaced) root.
+var userNSCommands = map[string]bool{
+	"build":    true,
+	"checkout": true,
+	"checkin":  true,
+	"abort":    true,
+	"chroot":   true,
+	"unpack":   true,
+	"gc":       true,
+}
+
+func layerMapOptions() *layer.MapOptions {
+	return &layer.MapOptions{Rootless: rootlessIDs}
+}
+
+func mtreeFsEval() fseval.FsEval {
+	if rootlessIDs {
+		return fseval.RootlessFsEval
+	}
+	return fseval.DefaultFsEval
+}
+
+// Return the first range of subordinate ids for the user named name
+// (or with id id) in file, which is /etc/subuid or /etc/subgid.
+func subIDRange(file string, name string, id string) (start string, count string, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != id) {
+			continue
+		}
+		if _, err := strconv.ParseUint(fields[1], 10, 32); err != nil {
+			return "", "", fmt.Errorf("Bad entry in %s: %s", file, scanner.Text())
+		}
+		if _, err := strconv.ParseUint(fields[2], 10, 32); err != nil {
+			return "", "", fmt.Errorf("Bad entry in %s: %s", file, scanner.Text())
+		}
+		return fields[1], fields[2], nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	return "", "", fmt.Errorf("No entry for %s in %s", name, file)
+}
+
+// Called first thing by a re-executed stacker: wait for the parent to
+// set up our id maps, and note which kind of mapping we have.
+func joinUserNS() error {
+	mode := os.Getenv(userNSEnv)
+	if mode == "" || mode == userNSMappedReady {
+		return nil
+	}
+	sync := os.NewFile(userNSSyncFd, "userns-sync")
+	buf := make([]byte, 1)
+	n, err := sync.Read(buf)
+	sync.Close()
+	if err != nil || n != 1 {
+		return fmt.Errorf("Parent failed setting up the user namespace")
+	}
+	rootlessIDs = mode == userNSSingle
+	if mode != userNSMapped {
+		return nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := os.Setenv(userNSEnv, userNSMappedReady); err != nil {
+		return err
+	}
+	return syscall.Exec(self, os.Args, os.Environ())
+}
+
+// Re-execute stacker with the same arguments in a new user namespace,
+// and return its exit code.
+func runInUserNS(c *stackerConfig) (int, error) {
+	if !userNSDrivers[c.FsType] {
+		return 1, fmt.Errorf("The %s driver needs root", c.FsType)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return 1, err
+	}
+	u, err := user.Current()
+	if err != nil {
+		return 1, err
+	}
+
+	uidStart, uidCount, uerr := subIDRange("/etc/subuid", u.Username, u.Uid)
+	gidStart, gidCount, gerr := subIDRange("/etc/subgid", u.Username, u.Uid)
+	mode := userNSMapped
+	if uerr != nil || gerr != nil {
+		mode = userNSSingle
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 1, err
+	}
+	defer w.Close()
+
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{r}
+	cmd.Env = append(os.Environ(), userNSEnv+"="+mode)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+	}
+	if mode == userNSSingle {
+		fmt.Fprintf(os.Stderr, "No subordinate ids for %s, file ownership will not be preserved\n", u.Username)
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	}
+
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		return 1, fmt.Errorf("Failed creating user namespace: %v", err)
+	}
+	r.Close()
+
+	if mode == userNSMapped {
+		pid := strconv.Itoa(cmd.Process.Pid)
+		_, err := runCaptured("newuidmap", pid, "0", u.Uid, "1", "1", uidStart, uidCount)
+		if err == nil {
+			_, err = runCaptured("newgidmap", pid, "0", u.Gid, "1", "1", gidStart, gidCount)
+		}
+		if err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return 1, fmt.Errorf("Failed mapping ids: %v", err)
+		}
+	}
+	w.Write([]byte{0})
+	w.Close()
+
+	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				return status.ExitStatus(), nil
+			}
+		}
+		return 1, err
+	}
+	return 0, nil
+}
@@ -15,17 +15,374 @@ package main
 // limitations under the License.
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/openSUSE/umoci/mutate"
+	"github.com/openSUSE/umoci/oci/casext"
+	"github.com/openSUSE/umoci/oci/layer"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/vbatts/go-mtree"
+	"golang.org/x/net/context"
+)
+
+// The vfs driver simply unpacks the full image for every checkout, and
+// diffs the whole rootfs against an mtree manifest at checkin.
+type vfsStorage struct {
+	c *stackerConfig
+}
+
+func init() {
+	registerStorage("vfs", func(c *stackerConfig) Storage { return &vfsStorage{c} })
+}
+
+func (s *vfsStorage) Setup() error {
+	return fmt.Errorf("Loopback setup not supported for vfs")
+}
+
+func (s *vfsStorage) Teardown() error {
+	return fmt.Errorf("Loopback setup not supported for vfs")
+}
+
+func (s *vfsStorage) Checkout(tag string) error {
+	if err := unpackBundle(s.c.OciDir, tag, s.c.UnpackDir()); err != nil {
+		os.RemoveAll(s.c.UnpackDir())
+		return fmt.Errorf("Failed unpacking: %v", err)
+	}
+	return nil
+}
+
+func (s *vfsStorage) Abort() error {
+	return os.RemoveAll(s.c.UnpackDir())
+}
+
+func (s *vfsStorage) Checkin(tag string, from ispec.Descriptor, update *imageUpdate) error {
+	if err := RepackBundle(s.c.OciDir, tag, s.c.UnpackDir(), from, update); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.c.UnpackDir())
+}
+
+func (s *vfsStorage) RootfsPath() string {
+	return s.c.BaseDir + "/unpacked" + s.c.checkoutSuffix() + "/rootfs"
+}
+
+func (s *vfsStorage) Describe(w io.Writer) {
+}
+
+func (s *vfsStorage) Health() storageHealth {
+	h := storageHealth{}
+	h.Used, h.Size = statfsUsage(s.c.BaseDir)
+	return h
+}
+
+func (s *vfsStorage) Dirty() (bool, error) {
+	diffs, err := bundleDiffs(s.c.UnpackDir())
+	return len(diffs) > 0, err
+}
+
+func (s *vfsStorage) Unpack() error {
+	return fmt.Errorf("CoW unpacking not supported for vfs")
+}
+
+func (s *vfsStorage) GC() error {
+	return nil
+}
+
+// Files stacker keeps in an unpacked bundle, next to rootfs and
+// config.json: an mtree manifest of the rootfs as unpacked, and the
+// manifest descriptor it was unpacked from.  Checkin diffs the rootfs
+// against these.
+const (
+	bundleMtreeName = "stacker.mtree"
+	bundleMetaName  = "stacker.json"
 )
 
-func VfsExpandLayer(ociDir string, tag string, unpackDir string) bool {
-	layout := fmt.Sprintf("%s:%s", ociDir, tag)
-	cmd := exec.Command("umoci", "unpack", "--image", layout, unpackDir)
-	if err := cmd.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed unpacking: %v\n", err)
-		return false
+var mtreeKeywords = []mtree.Keyword{
+	"size",
+	"type",
+	"uid",
+	"gid",
+	"mode",
+	"link",
+	"nlink",
+	"tar_time",
+	"sha256digest",
+	"xattr",
+}
+
+type bundleMeta struct {
+	From ispec.Descriptor `json:"from"`
+}
+
+func writeBundleMeta(bundle string, meta bundleMeta) error {
+	contents, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(bundle, bundleMetaName), contents, 0644)
+}
+
+func readBundleMeta(bundle string) (bundleMeta, error) {
+	meta := bundleMeta{}
+	contents, err := ioutil.ReadFile(filepath.Join(bundle, bundleMetaName))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(contents, &meta)
+	return meta, err
+}
+
+func writeBundleMtree(bundle string) error {
+	dh, err := mtree.Walk(filepath.Join(bundle, "rootfs"), nil, mtreeKeywords, mtreeFsEval())
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(bundle, bundleMtreeName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = dh.WriteTo(f)
+	return err
+}
+
+func readBundleMtree(bundle string) (*mtree.DirectoryHierarchy, error) {
+	f, err := os.Open(filepath.Join(bundle, bundleMtreeName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return mtree.ParseSpec(f)
+}
+
+// Write a minimal runtime config.json for image into bundle, for drivers
+// which put the rootfs in place themselves rather than via
+// layer.UnpackManifest.  A named user is looked up in the rootfs.
+func writeBundleRuntimeConfig(bundle string, image ispec.Image) error {
+	spec := rspec.Spec{
+		Version: rspec.Version,
+		Root:    &rspec.Root{Path: "rootfs"},
+		Process: &rspec.Process{
+			Args: append(append([]string{}, image.Config.Entrypoint...), image.Config.Cmd...),
+			Env:  image.Config.Env,
+			Cwd:  image.Config.WorkingDir,
+		},
+	}
+	if spec.Process.Cwd == "" {
+		spec.Process.Cwd = "/"
+	}
+	if image.Config.User != "" {
+		uid, gid, err := lookupUser(filepath.Join(bundle, "rootfs"), image.Config.User)
+		if err != nil {
+			return fmt.Errorf("Failed resolving user %s: %v", image.Config.User, err)
+		}
+		spec.Process.User.UID = uint32(uid)
+		spec.Process.User.GID = uint32(gid)
+	}
+	contents, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(bundle, "config.json"), contents, 0644)
+}
+
+// Given a bundle whose rootfs already holds the unpacked image desc,
+// write the config.json and metadata which make it a bundle that can be
+// checked in.  Drivers which check in via RepackBundle also need to call
+// writeBundleMtree.
+func finishBundle(ctx context.Context, engine casext.Engine, bundle string, desc ispec.Descriptor, manifest ispec.Manifest) error {
+	image, err := readImageConfig(ctx, engine, manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeBundleRuntimeConfig(bundle, image); err != nil {
+		return err
+	}
+	return writeBundleMeta(bundle, bundleMeta{From: desc})
+}
+
+// Unpack tag into a bundle at unpackDir.
+func unpackBundle(ociDir string, tag string, unpackDir string) error {
+	engine, err := openOCI(ociDir)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+
+	ctx := context.Background()
+	desc, manifest, err := tagManifest(ctx, engine, tag)
+	if err != nil {
+		return err
+	}
+	if err := layer.UnpackManifest(ctx, engine, unpackDir, manifest, layerMapOptions()); err != nil {
+		return err
+	}
+	if err := writeBundleMtree(unpackDir); err != nil {
+		return err
+	}
+	return writeBundleMeta(unpackDir, bundleMeta{From: desc})
+}
+
+// Return the changes made to the bundle's rootfs since it was unpacked.
+func bundleDiffs(bundle string) ([]mtree.InodeDelta, error) {
+	orig, err := readBundleMtree(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading bundle mtree: %v", err)
+	}
+	rootfs := filepath.Join(bundle, "rootfs")
+	cur, err := mtree.Walk(rootfs, nil, orig.UsedKeywords(), mtreeFsEval())
+	if err != nil {
+		return nil, fmt.Errorf("Failed walking rootfs: %v", err)
+	}
+	diffs, err := mtree.Compare(orig, cur, orig.UsedKeywords())
+	if err != nil {
+		return nil, fmt.Errorf("Failed diffing rootfs: %v", err)
+	}
+	return diffs, nil
+}
+
+// Diff the bundle against the image from it was unpacked from, and
+// store the result as a new layer under tag, applying update if it is
+// set.
+func RepackBundle(ociDir string, tag string, bundle string, from ispec.Descriptor, update *imageUpdate) error {
+	diffs, err := bundleDiffs(bundle)
+	if err != nil {
+		return err
+	}
+	rootfs := filepath.Join(bundle, "rootfs")
+
+	if len(diffs) == 0 {
+		_, err := commitLayer(ociDir, tag, from, nil, update)
+		return err
+	}
+
+	reader, err := layer.GenerateLayer(rootfs, diffs, layerMapOptions())
+	if err != nil {
+		return fmt.Errorf("Failed generating layer: %v", err)
+	}
+	defer reader.Close()
+	_, err = commitLayer(ociDir, tag, from, reader, update)
+	return err
+}
+
+// Changes to make to an image's config and manifest annotations as it
+// is checked in.  The annotations are also set on its tag's entry in the
+// index.
+type imageUpdate struct {
+	config      func(config *ispec.ImageConfig) error
+	annotations map[string]string
+}
+
+// Apply u to the image mutator is building, and return the manifest's
+// new annotations.
+func (u *imageUpdate) apply(ctx context.Context, mutator *mutate.Mutator) (map[string]string, error) {
+	image, err := mutator.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := mutator.Meta(ctx)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := mutator.Manifest(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	config := image.Config
+	if u.config != nil {
+		if err := u.config(&config); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	history := ispec.History{
+		Created:    &now,
+		CreatedBy:  "stacker config",
+		EmptyLayer: true,
+	}
+	annotations := mergeAnnotations(manifest.Annotations, u.annotations)
+	if err := mutator.Set(ctx, config, meta, annotations, history); err != nil {
+		return nil, fmt.Errorf("Failed updating image config: %v", err)
+	}
+	return annotations, nil
+}
+
+// Add the uncompressed layer read from reader on top of the image from,
+// apply update, and point tag at the result, which is returned.  Either
+// may be nil; if both are, tag is simply pointed at from.
+func commitLayer(ociDir string, tag string, from ispec.Descriptor, reader io.Reader, update *imageUpdate) (ispec.Descriptor, error) {
+	engine, err := openOCI(ociDir)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer engine.Close()
+	ctx := context.Background()
+
+	if reader == nil && update == nil {
+		return from, engine.UpdateReference(ctx, tag, from)
+	}
+
+	mutator, err := mutate.New(engine, casext.DescriptorPath{Walk: []ispec.Descriptor{from}})
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	if reader != nil {
+		now := time.Now()
+		history := ispec.History{
+			Created:   &now,
+			CreatedBy: "stacker checkin",
+		}
+		if err := mutator.Add(ctx, reader, history); err != nil {
+			return ispec.Descriptor{}, fmt.Errorf("Failed adding layer: %v", err)
+		}
+	}
+	var annotations map[string]string
+	if update != nil {
+		if annotations, err = update.apply(ctx, mutator); err != nil {
+			return ispec.Descriptor{}, err
+		}
+	}
+	newDesc, err := mutator.Commit(ctx)
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("Failed writing manifest: %v", err)
+	}
+	root := newDesc.Root()
+	if update == nil {
+		// The new manifest carries over the annotations of from,
+		// including ones which only describe from.
+		if root, err = dropAutoAnnotations(ctx, engine, root); err != nil {
+			return ispec.Descriptor{}, err
+		}
+	} else {
+		root.Annotations = annotations
+	}
+	return root, engine.UpdateReference(ctx, tag, root)
+}
+
+// Rewrite the manifest desc without the values of autoAnnotations, and
+// return the descriptor of the result, annotated like the manifest.
+func dropAutoAnnotations(ctx context.Context, engine casext.Engine, desc ispec.Descriptor) (ispec.Descriptor, error) {
+	manifest, err := readManifest(ctx, engine, desc)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	manifest.Annotations = mergeAnnotations(manifest.Annotations, nil)
+	digest, size, err := engine.PutBlobJSON(ctx, manifest)
+	if err != nil {
+		return ispec.Descriptor{}, fmt.Errorf("Failed writing manifest: %v", err)
 	}
-	return true
+	return ispec.Descriptor{
+		MediaType:   ispec.MediaTypeImageManifest,
+		Digest:      digest,
+		Size:        size,
+		Annotations: manifest.Annotations,
+	}, nil
 }
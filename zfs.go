@@ -0,0 +1,347 @@
+package main
+
+// Copyright (C) 2017 Cisco Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/openSUSE/umoci/oci/casext"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+)
+
+// The zfs driver keeps every OCI layer in a dataset named
+// <pool>/layers/<chain id>.  Each layer's dataset is a clone of its parent
+// layer's @layer snapshot with the layer applied on top, and is itself
+// snapshotted as @layer once unpacked.  A checkout is a writable clone of
+// the top layer's snapshot, mounted as the rootfs of the unpack dir.
+type zfsStorage struct {
+	c *stackerConfig
+}
+
+func init() {
+	registerStorage("zfs", func(c *stackerConfig) Storage { return &zfsStorage{c} })
+}
+
+const zfsLayerSnap = "layer"
+
+func zfsPoolName(c *stackerConfig) string {
+	return strings.SplitN(c.ZfsPool, "/", 2)[0]
+}
+
+func zfsLayerDataset(c *stackerConfig, chainID string) string {
+	return fmt.Sprintf("%s/layers/%s", c.ZfsPool, chainID)
+}
+
+func zfsCheckoutDataset(c *stackerConfig) string {
+	return fmt.Sprintf("%s/checkout%s", c.ZfsPool, c.checkoutSuffix())
+}
+
+func zfsDatasetExists(name string) bool {
+	_, err := runCaptured("zfs", "list", "-H", "-o", "name", name)
+	return err == nil
+}
+
+func zfsMountpoint(name string) (string, error) {
+	return runCaptured("zfs", "get", "-H", "-o", "value", "mountpoint", name)
+}
+
+// Make sure every layer of manifest has a dataset, and return the name of
+// the top layer's dataset, or "" if the image has no layers.
+func zfsUnpackLayers(ctx context.Context, engine casext.Engine, c *stackerConfig, manifest ispec.Manifest) (string, error) {
+	if !zfsDatasetExists(c.ZfsPool + "/layers") {
+		if _, err := runCaptured("zfs", "create", "-p", c.ZfsPool+"/layers"); err != nil {
+			return "", err
+		}
+	}
+
+	prev := ""
+	chainIDs := layerChainIDs(manifest)
+	for i, l := range manifest.Layers {
+		ds := zfsLayerDataset(c, chainIDs[i])
+		snap := ds + "@" + zfsLayerSnap
+		if zfsDatasetExists(snap) {
+			prev = ds
+			continue
+		}
+		// A dataset without its snapshot is left over from an
+		// interrupted unpack.
+		if zfsDatasetExists(ds) {
+			if _, err := runCaptured("zfs", "destroy", "-r", ds); err != nil {
+				return "", err
+			}
+		}
+
+		var err error
+		if prev == "" {
+			_, err = runCaptured("zfs", "create", ds)
+		} else {
+			_, err = runCaptured("zfs", "clone", prev+"@"+zfsLayerSnap, ds)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		mnt, err := zfsMountpoint(ds)
+		if err == nil {
+			err = applyLayer(ctx, engine, l, mnt)
+		}
+		if err == nil {
+			_, err = runCaptured("zfs", "snapshot", snap)
+		}
+		if err != nil {
+			runCaptured("zfs", "destroy", "-r", ds)
+			return "", fmt.Errorf("Failed unpacking layer %s: %v", l.Digest, err)
+		}
+		prev = ds
+	}
+	return prev, nil
+}
+
+func (s *zfsStorage) Unpack() error {
+	return forEachTagManifest(s.c, func(ctx context.Context, engine casext.Engine, manifest ispec.Manifest) error {
+		_, err := zfsUnpackLayers(ctx, engine, s.c, manifest)
+		return err
+	})
+}
+
+func (s *zfsStorage) Checkout(tag string) error {
+	engine, err := openOCI(s.c.OciDir)
+	if err != nil {
+		return err
+	}
+	defer engine.Close()
+	ctx := context.Background()
+
+	desc, manifest, err := tagManifest(ctx, engine, tag)
+	if err != nil {
+		return err
+	}
+	top, err := zfsUnpackLayers(ctx, engine, s.c, manifest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.c.UnpackDir(), 0755); err != nil {
+		return err
+	}
+	// zfs only takes absolute mountpoints.
+	rootfs, err := filepath.Abs(s.c.RootfsDir())
+	if err != nil {
+		return err
+	}
+	mountOpt := "mountpoint=" + rootfs
+	if top == "" {
+		_, err = runCaptured("zfs", "create", "-o", mountOpt, zfsCheckoutDataset(s.c))
+	} else {
+		_, err = runCaptured("zfs", "clone", "-o", mountOpt, top+"@"+zfsLayerSnap, zfsCheckoutDataset(s.c))
+	}
+	if err != nil {
+		os.RemoveAll(s.c.UnpackDir())
+		return err
+	}
+
+	if err := finishBundle(ctx, engine, s.c.UnpackDir(), desc, manifest); err != nil {
+		s.Abort()
+		return err
+	}
+	if err := writeBundleMtree(s.c.UnpackDir()); err != nil {
+		s.Abort()
+		return err
+	}
+	return nil
+}
+
+func (s *zfsStorage) Checkin(tag string, from ispec.Descriptor, update *imageUpdate) error {
+	if err := RepackBundle(s.c.OciDir, tag, s.c.UnpackDir(), from, update); err != nil {
+		return err
+	}
+	return s.Abort()
+}
+
+// Destroy the checkout clone and remove the unpack dir.
+func (s *zfsStorage) Abort() error {
+	if zfsDatasetExists(zfsCheckoutDataset(s.c)) {
+		if _, err := runCaptured("zfs", "destroy", zfsCheckoutDataset(s.c)); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(s.c.UnpackDir())
+}
+
+func zfsPoolImported(pool string) bool {
+	_, err := runCaptured("zpool", "list", "-H", "-o", "name", pool)
+	return err == nil
+}
+
+// Return the paths of the devices (or files) backing pool.
+func zfsPoolVdevs(pool string) ([]string, error) {
+	out, err := runCaptured("zpool", "list", "-H", "-P", "-v", "-o", "name", pool)
+	if err != nil {
+		return nil, err
+	}
+	vdevs := []string{}
+	for _, line := range strings.Split(out, "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			vdevs = append(vdevs, fields[0])
+		}
+	}
+	return vdevs, nil
+}
+
+// Return the absolute path of the loopback file, which must be set.
+func (s *zfsStorage) loFile() (string, error) {
+	if s.c.LoFile == "" {
+		return "", fmt.Errorf("No loopback file configured for zfs")
+	}
+	return filepath.Abs(s.c.LoFile)
+}
+
+// Create a pool backed by lofile if needed, and make sure it is imported.
+func (s *zfsStorage) Setup() error {
+	pool := zfsPoolName(s.c)
+	lofile, err := s.loFile()
+	if err != nil {
+		return err
+	}
+	if zfsPoolImported(pool) {
+		return nil
+	}
+	if FileExists(lofile) {
+		_, err := runCaptured("zpool", "import", "-d", filepath.Dir(lofile), pool)
+		return err
+	}
+
+	if _, err := runCaptured("truncate", "-s", "20G", lofile); err != nil {
+		return err
+	}
+	mnt, err := filepath.Abs(filepath.Join(s.c.BaseDir, "zfs"))
+	if err != nil {
+		return err
+	}
+	if _, err := runCaptured("zpool", "create", "-m", mnt, pool, lofile); err != nil {
+		os.Remove(lofile)
+		return err
+	}
+	if s.c.ZfsPool != pool {
+		_, err = runCaptured("zfs", "create", "-p", s.c.ZfsPool)
+	}
+	return err
+}
+
+// Destroy the pool and its loopback file.  Only a pool backed by nothing
+// but our loopback file is destroyed; any other pool of the same name
+// belongs to someone else.
+func (s *zfsStorage) Teardown() error {
+	pool := zfsPoolName(s.c)
+	lofile, err := s.loFile()
+	if err != nil {
+		return err
+	}
+	if zfsPoolImported(pool) {
+		vdevs, err := zfsPoolVdevs(pool)
+		if err != nil {
+			return err
+		}
+		if len(vdevs) != 1 || vdevs[0] != lofile {
+			return fmt.Errorf("Refusing to destroy pool %s: it is not backed by %s", pool, lofile)
+		}
+		if _, err := runCaptured("zpool", "destroy", pool); err != nil {
+			return err
+		}
+	}
+	if FileExists(lofile) {
+		if err := os.Remove(lofile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *zfsStorage) RootfsPath() string {
+	return s.c.BaseDir + "/unpacked" + s.c.checkoutSuffix() + "/rootfs"
+}
+
+func (s *zfsStorage) Describe(w io.Writer) {
+	fmt.Fprintf(w, "  dataset: %s\n", s.c.ZfsPool)
+	if s.c.LoFile != "" {
+		fmt.Fprintf(w, "  loopback file: %s\n", s.c.LoFile)
+	}
+}
+
+func (s *zfsStorage) Health() storageHealth {
+	h := storageHealth{
+		LoFile:       s.c.LoFile,
+		LoFileExists: s.c.LoFile != "" && FileExists(s.c.LoFile),
+		Mounted:      zfsPoolImported(zfsPoolName(s.c)),
+	}
+	if !h.Mounted {
+		return h
+	}
+	out, err := runCaptured("zfs", "get", "-H", "-p", "-o", "value", "used,available", s.c.ZfsPool)
+	if err != nil {
+		return h
+	}
+	vals := strings.Fields(out)
+	if len(vals) == 2 {
+		used, _ := strconv.ParseUint(vals[0], 10, 64)
+		avail, _ := strconv.ParseUint(vals[1], 10, 64)
+		h.Used, h.Size = used, used+avail
+	}
+	return h
+}
+
+func (s *zfsStorage) Dirty() (bool, error) {
+	diffs, err := bundleDiffs(s.c.UnpackDir())
+	return len(diffs) > 0, err
+}
+
+// Destroy layer datasets no tag uses.  A layer's snapshot can't be
+// destroyed while a clone of it exists, so keep going round until no
+// more progress is made; anything left is a parent of a layer in use.
+func (s *zfsStorage) GC() error {
+	layers, err := referencedChains(s.c)
+	if err != nil {
+		return err
+	}
+	out, err := runCaptured("zfs", "list", "-H", "-o", "name", "-d", "1", s.c.ZfsPool+"/layers")
+	if err != nil {
+		return err
+	}
+	unused := []string{}
+	for _, ds := range strings.Split(out, "\n") {
+		if name := filepath.Base(ds); isLayerDigest(name) && !layers[name] {
+			unused = append(unused, ds)
+		}
+	}
+	for progress := true; progress && len(unused) > 0; {
+		progress = false
+		remaining := []string{}
+		for _, ds := range unused {
+			if _, err := runCaptured("zfs", "destroy", "-r", ds); err != nil {
+				remaining = append(remaining, ds)
+				continue
+			}
+			progress = true
+		}
+		unused = remaining
+	}
+	return nil
+}